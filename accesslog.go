@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// An accessLogEntry records a single HTTP request, written as one line of
+// JSON.
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Range     string    `json:"range,omitempty"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"` // seconds
+	UserAgent string    `json:"userAgent,omitempty"`
+	Hosts     []string  `json:"hosts,omitempty"`
+	Aborted   bool      `json:"aborted,omitempty"`
+}
+
+// A requestNote collects details of a request that are only known to the
+// handler serving it, for use by the access log and metrics.
+type requestNote struct {
+	mu      sync.Mutex
+	hosts   []string
+	errType string // see errorType
+}
+
+type requestNoteKey struct{}
+
+// withRequestNote returns req with a requestNote attached to its context,
+// along with the note. If req already has a note, it is reused.
+func withRequestNote(req *http.Request) (*http.Request, *requestNote) {
+	if rn, ok := req.Context().Value(requestNoteKey{}).(*requestNote); ok {
+		return req, rn
+	}
+	rn := new(requestNote)
+	return req.WithContext(context.WithValue(req.Context(), requestNoteKey{}, rn)), rn
+}
+
+// noteHosts records the hosts storing the file served in response to req.
+func noteHosts(req *http.Request, hosts []string) {
+	if rn, ok := req.Context().Value(requestNoteKey{}).(*requestNote); ok {
+		rn.mu.Lock()
+		rn.hosts = hosts
+		rn.mu.Unlock()
+	}
+}
+
+// noteError records the first error that caused req to fail.
+func noteError(req *http.Request, err error) {
+	if rn, ok := req.Context().Value(requestNoteKey{}).(*requestNote); ok {
+		errType := errorType(err)
+		rn.mu.Lock()
+		if rn.errType == "" {
+			rn.errType = errType
+		}
+		rn.mu.Unlock()
+	}
+}
+
+func (rn *requestNote) getHosts() []string {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	return rn.hosts
+}
+
+func (rn *requestNote) getErrorType() string {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	return rn.errType
+}
+
+// A statusRecorder records the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(p)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+// An accessLogHandler writes an accessLogEntry for each request.
+type accessLogHandler struct {
+	h  http.Handler
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// ServeHTTP implements http.Handler.
+func (lh *accessLogHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	req, rn := withRequestNote(req)
+	sr := &statusRecorder{ResponseWriter: w}
+	aborted := true
+	defer func() {
+		// runs even if the handler panics (e.g. with http.ErrAbortHandler)
+		e := accessLogEntry{
+			Time:      start.UTC(),
+			Client:    clientAddr(req),
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			Range:     req.Header.Get("Range"),
+			Status:    sr.status,
+			Bytes:     sr.bytes,
+			Duration:  time.Since(start).Seconds(),
+			UserAgent: req.UserAgent(),
+			Hosts:     rn.getHosts(),
+			Aborted:   aborted,
+		}
+		if e.Status == 0 && !aborted {
+			e.Status = http.StatusOK
+		}
+		lh.mu.Lock()
+		json.NewEncoder(lh.w).Encode(e)
+		lh.mu.Unlock()
+	}()
+	lh.h.ServeHTTP(sr, req)
+	aborted = false
+}
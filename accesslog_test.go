@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAccessLogHosts(t *testing.T) {
+	root := t.TempDir()
+	for name, contents := range map[string]string{
+		"file":               "hello, world",
+		"file" + metafileExt: "v1",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	lh := &accessLogHandler{
+		h: &metricsHandler{
+			h: &etagHandler{
+				h:    http.FileServer(http.Dir(root)),
+				root: root,
+				tags: etagCache{read: testETag},
+			},
+		},
+		w: &buf,
+	}
+	get := func(target string) accessLogEntry {
+		buf.Reset()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Range", "bytes=0-4")
+		lh.ServeHTTP(rec, req)
+		var e accessLogEntry
+		if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	e := get("/file")
+	if e.Status != http.StatusPartialContent || e.Bytes != 5 || e.Range != "bytes=0-4" {
+		t.Errorf("unexpected entry %+v", e)
+	} else if exp := []string{"host1", "host2"}; !reflect.DeepEqual(e.Hosts, exp) {
+		t.Errorf("expected hosts %v, got %v", exp, e.Hosts)
+	}
+	// requests that don't read a metafile have no hosts
+	if e := get("/missing"); e.Status != http.StatusNotFound || e.Hosts != nil {
+		t.Errorf("unexpected entry %+v", e)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/renterutil"
+)
+
+// apiPrefix is the URL prefix of the JSON API.
+const apiPrefix = "/api/"
+
+// An apiFile describes a file or directory in JSON responses.
+type apiFile struct {
+	Name        string     `json:"name"`
+	Size        int64      `json:"size"`
+	Mode        string     `json:"mode"`
+	ModTime     time.Time  `json:"modTime"`
+	IsDir       bool       `json:"isDir"`
+	MinShards   int        `json:"minShards,omitempty"`
+	Hosts       []string   `json:"hosts,omitempty"`
+	Redundancy  float64    `json:"redundancy,omitempty"`
+	UploadedPct float64    `json:"uploadedPct,omitempty"`
+	Health      string     `json:"health,omitempty"`
+	Version     int        `json:"version,omitempty"`
+	Shards      []apiShard `json:"shards,omitempty"`
+}
+
+// An apiShard describes the data stored on a single host.
+type apiShard struct {
+	Host     string `json:"host"`
+	Uploaded int64  `json:"uploaded"`
+	Sectors  int    `json:"sectors"`
+}
+
+// An apiDir describes a directory and its contents.
+type apiDir struct {
+	apiFile
+	Files []apiFile `json:"files"`
+}
+
+// newAPIFile describes the file or directory name, a slash-separated path
+// within the metafolder at root. Sia-specific fields are omitted if the
+// metafile can't be read (e.g. because the file is still being written). If
+// detail is true, the metafile version and the data stored on each host are
+// included as well.
+func newAPIFile(root, name string, info os.FileInfo, detail bool) apiFile {
+	f := apiFile{
+		Name:    name,
+		Size:    info.Size(),
+		Mode:    info.Mode().String(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}
+	if f.IsDir {
+		f.Size = 0
+		return f
+	}
+	m, err := renter.ReadMetaFile(filepath.Join(root, filepath.FromSlash(name)) + metafileExt)
+	if err != nil {
+		return f
+	}
+	f.MinShards = m.MinShards
+	for _, h := range m.Hosts {
+		f.Hosts = append(f.Hosts, string(h))
+	}
+	f.Redundancy = float64(len(m.Hosts)) / float64(m.MinShards)
+	_, f.UploadedPct = uploadProgress(m)
+	f.Health = fileHealth(m)
+	if detail {
+		f.Version = m.Version
+		for i, shard := range m.Shards {
+			s := apiShard{Host: string(m.Hosts[i]), Sectors: len(shard)}
+			for _, ss := range shard {
+				s.Uploaded += int64(ss.NumSegments * merkle.SegmentSize)
+			}
+			f.Shards = append(f.Shards, s)
+		}
+	}
+	return f
+}
+
+// writeJSON writes v as the JSON body of a response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// apiError writes a JSON error corresponding to err.
+func apiError(w http.ResponseWriter, req *http.Request, err error) {
+	noteError(req, err)
+	cause := errors.Cause(err)
+	status := http.StatusInternalServerError
+	switch {
+	case os.IsNotExist(cause):
+		status = http.StatusNotFound
+	case os.IsPermission(cause):
+		status = http.StatusForbidden
+	default:
+		log.Printf("%v %v: %v", req.Method, req.URL.Path, err)
+	}
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{http.StatusText(status)})
+}
+
+// An apiHandler serves JSON descriptions of the files in a PseudoFS. A GET
+// request for a directory returns its contents; a GET request for a file
+// returns its metadata, including the data stored on each host.
+type apiHandler struct {
+	pfs  *renterutil.PseudoFS
+	root string
+}
+
+// ServeHTTP implements http.Handler.
+func (ah *apiHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, struct {
+			Error string `json:"error"`
+		}{"method not allowed"})
+		return
+	}
+	name := strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(req.URL.Path, apiPrefix)), "/")
+	info, err := ah.pfs.Stat(name)
+	if err != nil {
+		apiError(w, req, err)
+		return
+	}
+	if !info.IsDir() {
+		writeJSON(w, http.StatusOK, newAPIFile(ah.root, name, info, true))
+		return
+	}
+	infos, err := readDir(ah.pfs, ah.root, name)
+	if err != nil {
+		apiError(w, req, err)
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	d := apiDir{
+		apiFile: newAPIFile(ah.root, name, info, false),
+		Files:   []apiFile{},
+	}
+	for _, info := range infos {
+		d.Files = append(d.Files, newAPIFile(ah.root, path.Join(name, info.Name()), info, false))
+	}
+	writeJSON(w, http.StatusOK, d)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// An archiveWriter writes files to an archive.
+type archiveWriter interface {
+	writeEntry(name string, info os.FileInfo, r io.Reader) error
+	writeSymlink(name, target string, modTime time.Time) error
+	Close() error
+}
+
+type tarArchive struct {
+	tw *tar.Writer
+	gz *gzip.Writer // may be nil
+}
+
+func (ta *tarArchive) writeEntry(name string, info os.FileInfo, r io.Reader) error {
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := ta.tw.WriteHeader(hdr); err != nil {
+		return err
+	} else if r == nil {
+		return nil
+	}
+	_, err = io.Copy(ta.tw, r)
+	return err
+}
+
+func (ta *tarArchive) writeSymlink(name, target string, modTime time.Time) error {
+	return ta.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  modTime,
+	})
+}
+
+func (ta *tarArchive) Close() error {
+	if err := ta.tw.Close(); err != nil {
+		return err
+	} else if ta.gz != nil {
+		return ta.gz.Close()
+	}
+	return nil
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (za *zipArchive) writeEntry(name string, info os.FileInfo, r io.Reader) error {
+	hdr, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	} else {
+		hdr.Method = zip.Deflate
+	}
+	w, err := za.zw.CreateHeader(hdr)
+	if err != nil || r == nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// writeSymlink writes a symlink using the Info-ZIP convention: the entry's
+// mode marks it as a symlink, and its contents are the target.
+func (za *zipArchive) writeSymlink(name, target string, modTime time.Time) error {
+	hdr := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modTime,
+	}
+	hdr.SetMode(os.ModeSymlink | 0777)
+	w, err := za.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, target)
+	return err
+}
+
+func (za *zipArchive) Close() error {
+	return za.zw.Close()
+}
+
+// archiveFormats maps values of the archive query parameter to their file
+// extensions and content types.
+var archiveFormats = map[string]struct {
+	ext         string
+	contentType string
+}{
+	"tar":    {".tar", "application/x-tar"},
+	"tar.gz": {".tar.gz", "application/gzip"},
+	"tgz":    {".tar.gz", "application/gzip"},
+	"zip":    {".zip", "application/zip"},
+}
+
+func newArchiveWriter(format string, w io.Writer) archiveWriter {
+	switch format {
+	case "tar":
+		return &tarArchive{tw: tar.NewWriter(w)}
+	case "tar.gz", "tgz":
+		gz := gzip.NewWriter(w)
+		return &tarArchive{tw: tar.NewWriter(gz), gz: gz}
+	case "zip":
+		return &zipArchive{zw: zip.NewWriter(w)}
+	}
+	panic("unknown archive format " + format)
+}
+
+// An archiveHandler serves GET requests for directories with an archive query
+// parameter (e.g. ?archive=zip) by streaming an archive of the directory's
+// contents. Archives are built on the fly, one file at a time. Symlinks are
+// archived as symlinks, with their targets unchanged. Other requests are
+// passed to the underlying handler.
+type archiveHandler struct {
+	h    http.Handler
+	fs   http.FileSystem // omits metadata entries from listings, like httpFS
+	root string          // the metafolder, for reading symlink entries
+}
+
+// ServeHTTP implements http.Handler.
+func (ah *archiveHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	format := req.URL.Query().Get("archive")
+	if format == "" || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		ah.h.ServeHTTP(w, req)
+		return
+	}
+	af, ok := archiveFormats[format]
+	if !ok {
+		http.Error(w, "unsupported archive format; use tar, tar.gz, or zip", http.StatusBadRequest)
+		return
+	}
+	dir := path.Clean("/" + req.URL.Path)
+	info, err := ah.stat(dir)
+	if err != nil {
+		davError(w, req, err)
+		return
+	} else if !info.IsDir() {
+		http.Error(w, "archives are only available for directories", http.StatusBadRequest)
+		return
+	}
+	base := path.Base(dir)
+	if base == "/" {
+		base = "root"
+	}
+	w.Header().Set("Content-Type", af.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.Replace(base, `"`, "", -1)+af.ext+`"`)
+	if req.Method == http.MethodHead {
+		return
+	}
+	aw := newArchiveWriter(format, w)
+	err = ah.writeDir(aw, dir, base)
+	if err == nil {
+		err = aw.Close()
+	}
+	if err != nil {
+		// the response is already underway, so the best we can do is abort
+		// it, ensuring that the client doesn't mistake it for a complete
+		// archive
+		log.Printf("%v %v: %v", req.Method, req.URL.Path, err)
+		noteError(req, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (ah *archiveHandler) stat(name string) (os.FileInfo, error) {
+	f, err := ah.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+// An archiveEntry is a file, directory, or symlink within an archived
+// directory.
+type archiveEntry struct {
+	name    string
+	info    os.FileInfo
+	symlink bool
+	target  string
+}
+
+// readArchiveDir returns the entries of dir, sorted by name.
+func (ah *archiveHandler) readArchiveDir(dir string) ([]archiveEntry, error) {
+	d, err := ah.fs.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read %v", dir)
+	}
+	var entries []archiveEntry
+	for _, info := range infos {
+		entries = append(entries, archiveEntry{name: info.Name(), info: info})
+	}
+	// symlink entries are hidden from listings, so find them in the
+	// metafolder itself
+	metaDir := filepath.Join(ah.root, filepath.FromSlash(dir))
+	infos, err = ioutil.ReadDir(metaDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read %v", dir)
+	}
+	for _, info := range infos {
+		if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), symlinkExt) {
+			target, err := readSymlinkEntry(filepath.Join(metaDir, info.Name()))
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not read symlink %v", path.Join(dir, info.Name()))
+			}
+			entries = append(entries, archiveEntry{
+				name:    strings.TrimSuffix(info.Name(), symlinkExt),
+				info:    info,
+				symlink: true,
+				target:  target,
+			})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+// writeDir recursively writes the contents of dir to aw, naming each entry
+// relative to prefix.
+func (ah *archiveHandler) writeDir(aw archiveWriter, dir, prefix string) error {
+	entries, err := ah.readArchiveDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := path.Join(dir, e.name)
+		entry := path.Join(prefix, e.name)
+		if e.symlink {
+			if err := aw.writeSymlink(entry, e.target, e.info.ModTime()); err != nil {
+				return errors.Wrapf(err, "could not archive %v", name)
+			}
+			continue
+		} else if e.info.IsDir() {
+			if err := aw.writeEntry(entry, e.info, nil); err != nil {
+				return err
+			} else if err := ah.writeDir(aw, name, entry); err != nil {
+				return err
+			}
+			continue
+		} else if !e.info.Mode().IsRegular() {
+			continue // e.g. a stray OS symlink in the metafolder
+		}
+		f, err := ah.fs.Open(name)
+		if err != nil {
+			return errors.Wrapf(err, "could not open %v", name)
+		}
+		err = aw.writeEntry(entry, e.info, f)
+		f.Close()
+		if err != nil {
+			return errors.Wrapf(err, "could not archive %v", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testArchiveTree creates a small tree for archiving, returning its root.
+func testArchiveTree(t *testing.T) string {
+	root := t.TempDir()
+	files := map[string]string{
+		"photos/a.jpg":            "aaaa",
+		"photos/b.jpg":            "bbbbbbbb",
+		"photos/2021/c.jpg":       "c",
+		"photos/" + dirConfigFile: "min_shards = 3\n",
+		"other.txt":               "not archived",
+	}
+	for name, contents := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(p, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "photos", "empty"), 0700); err != nil {
+		t.Fatal(err)
+	} else if err := writeSymlinkEntry("a.jpg", filepath.Join(root, "photos", "latest")); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// archiveContents describes each entry of an archive: "dir/" for
+// directories, "-> target" for symlinks, and the contents of files.
+type archiveContents map[string]string
+
+var testArchiveContents = archiveContents{
+	"photos/2021/":      "",
+	"photos/2021/c.jpg": "c",
+	"photos/a.jpg":      "aaaa",
+	"photos/b.jpg":      "bbbbbbbb",
+	"photos/empty/":     "",
+	"photos/latest":     "-> a.jpg",
+}
+
+func readTar(t *testing.T, r io.Reader) archiveContents {
+	contents := make(archiveContents)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return contents
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			contents[hdr.Name] = ""
+		case tar.TypeSymlink:
+			contents[hdr.Name] = "-> " + hdr.Linkname
+		case tar.TypeReg:
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents[hdr.Name] = string(data)
+		default:
+			t.Fatalf("unexpected entry type %v for %v", hdr.Typeflag, hdr.Name)
+		}
+	}
+}
+
+func readZip(t *testing.T, data []byte) archiveContents {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(archiveContents)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch mode := f.Mode(); {
+		case mode.IsDir():
+			contents[f.Name] = ""
+		case mode&os.ModeSymlink != 0:
+			contents[f.Name] = "-> " + string(data)
+		default:
+			contents[f.Name] = string(data)
+		}
+	}
+	return contents
+}
+
+// A listingDir is an http.Dir whose listings omit metadata entries, as
+// httpFS's do.
+type listingDir struct {
+	http.Dir
+}
+
+func (d listingDir) Open(name string) (http.File, error) {
+	f, err := d.Dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return listingFile{f}, nil
+}
+
+type listingFile struct {
+	http.File
+}
+
+func (f listingFile) Readdir(n int) ([]os.FileInfo, error) {
+	infos, err := f.File.Readdir(n)
+	filtered := infos[:0]
+	for _, info := range infos {
+		if !isMetadataEntry(info) {
+			filtered = append(filtered, info)
+		}
+	}
+	return filtered, err
+}
+
+func TestArchiveHandler(t *testing.T) {
+	root := testArchiveTree(t)
+	ah := &archiveHandler{
+		h:    http.FileServer(http.Dir(root)),
+		fs:   listingDir{http.Dir(root)},
+		root: root,
+	}
+	get := func(method, url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ah.ServeHTTP(rec, httptest.NewRequest(method, url, nil))
+		return rec
+	}
+
+	for _, format := range []string{"tar", "tar.gz", "tgz", "zip"} {
+		rec := get(http.MethodGet, "/photos/?archive="+format)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%v: unexpected status %v: %s", format, rec.Code, rec.Body.Bytes())
+		}
+		af := archiveFormats[format]
+		if ct := rec.Header().Get("Content-Type"); ct != af.contentType {
+			t.Errorf("%v: wrong content type %q", format, ct)
+		} else if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="photos`+af.ext+`"` {
+			t.Errorf("%v: wrong content disposition %q", format, cd)
+		}
+		var contents archiveContents
+		switch format {
+		case "tar":
+			contents = readTar(t, rec.Body)
+		case "tar.gz", "tgz":
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents = readTar(t, gz)
+		case "zip":
+			contents = readZip(t, rec.Body.Bytes())
+		}
+		if !reflect.DeepEqual(contents, testArchiveContents) {
+			t.Errorf("%v: wrong contents:\n%v\nexpected:\n%v", format, contents, testArchiveContents)
+		}
+	}
+
+	if rec := get(http.MethodHead, "/photos?archive=zip"); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("HEAD: unexpected response %v (%v bytes)", rec.Code, rec.Body.Len())
+	}
+	if rec := get(http.MethodGet, "/photos?archive=rar"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unsupported format: expected 400, got %v", rec.Code)
+	}
+	if rec := get(http.MethodGet, "/other.txt?archive=zip"); rec.Code != http.StatusBadRequest {
+		t.Errorf("file: expected 400, got %v", rec.Code)
+	}
+	if rec := get(http.MethodGet, "/missing?archive=zip"); rec.Code != http.StatusNotFound {
+		t.Errorf("missing: expected 404, got %v", rec.Code)
+	}
+	// requests without the query parameter are passed through
+	if rec := get(http.MethodGet, "/other.txt"); rec.Code != http.StatusOK || rec.Body.String() != "not archived" {
+		t.Errorf("passthrough: unexpected response %v %q", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// constantTimeEqual reports whether a and b are equal, without leaking their
+// contents through timing.
+func constantTimeEqual(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// An authHandler requires requests to present either HTTP basic auth
+// credentials or a bearer token before passing them to the underlying
+// handler. If neither a password nor a token is configured, all requests are
+// allowed.
+type authHandler struct {
+	h        http.Handler
+	user     string
+	password string
+	token    string
+}
+
+func (ah *authHandler) enabled() bool {
+	return ah.password != "" || ah.token != ""
+}
+
+func (ah *authHandler) authorized(req *http.Request) bool {
+	if !ah.enabled() {
+		return true
+	}
+	if ah.token != "" {
+		auth := req.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") && constantTimeEqual(strings.TrimPrefix(auth, "Bearer "), ah.token) {
+			return true
+		}
+	}
+	if ah.password != "" {
+		if user, pass, ok := req.BasicAuth(); ok && constantTimeEqual(user, ah.user) && constantTimeEqual(pass, ah.password) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP implements http.Handler.
+func (ah *authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !ah.authorized(req) {
+		if ah.password != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="user", charset="UTF-8"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="user"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ah.h.ServeHTTP(w, req)
+}
+
+// isLoopback reports whether addr only accepts connections from the local
+// machine.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// selfSignedCert generates a self-signed TLS certificate for localhost and
+// the machine's hostname. It also returns the SHA-256 fingerprint of the
+// certificate, so that clients can verify it out-of-band.
+func selfSignedCert() (tls.Certificate, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"user"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, "", err
+	}
+	fp := sha256.Sum256(der)
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+	return cert, hex.EncodeToString(fp[:]), nil
+}
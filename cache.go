@@ -0,0 +1,305 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/renter"
+)
+
+// cacheBlockSize is the granularity at which file data is cached. It is much
+// smaller than a sector, so that random reads don't need to download (and
+// cache) entire chunks.
+const cacheBlockSize = 1 << 20 // 1 MiB
+
+var (
+	cacheHits        = newCounterVec("user_cache_hits_total", "Number of blocks read from the block cache.")
+	cacheMisses      = newCounterVec("user_cache_misses_total", "Number of blocks not found in the block cache.")
+	downloadDuration = newHistogramVec("user_download_duration_seconds", "Latency of reads from hosts, including decryption and erasure decoding.", latencyBuckets)
+)
+
+// A timedReaderAt records the latency of each read from hosts.
+type timedReaderAt struct {
+	r io.ReaderAt
+}
+
+// ReadAt implements io.ReaderAt.
+func (t timedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	defer downloadDuration.since(time.Now())
+	return t.r.ReadAt(p, off)
+}
+
+// A blockCache is a size-bounded, on-disk LRU cache of decrypted file data.
+// Blocks are keyed by a hash of the Merkle roots of the file they belong to,
+// so a block can never become stale: modifying a file changes its roots, and
+// thus its keys.
+type blockCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // most recently used at front
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+func (c *blockCache) path(key string) string {
+	return filepath.Join(c.dir, key)
+}
+
+// add inserts an entry at the front of the LRU list. c.mu must be held.
+func (c *blockCache) add(key string, size int64) {
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, size})
+	c.size += size
+}
+
+// evict removes the least recently used entries until the cache fits within
+// maxSize. c.mu must be held.
+func (c *blockCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		e := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, e.key)
+		c.size -= e.size
+		os.Remove(c.path(e.key))
+	}
+}
+
+// remove forgets the entry for key, so that it can be replaced.
+func (c *blockCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.size -= elem.Value.(*cacheEntry).size
+	}
+}
+
+// get reads len(p) bytes at off from the cached block key, which must be size
+// bytes long, reporting whether the block was cached. Only the requested
+// range is read from disk.
+func (c *blockCache) get(key string, size int64, p []byte, off int64) bool {
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(elem)
+		ok = elem.Value.(*cacheEntry).size == size
+	}
+	c.mu.Unlock()
+	if !ok {
+		if elem != nil {
+			c.remove(key) // truncated, most likely
+		}
+		return false
+	}
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		// evicted by another process, most likely
+		c.remove(key)
+		return false
+	}
+	_, err = f.ReadAt(p, off)
+	f.Close()
+	if err != nil {
+		c.remove(key)
+		return false
+	}
+	// persist recency, so that LRU order survives restarts
+	now := time.Now()
+	os.Chtimes(c.path(key), now, now)
+	return true
+}
+
+func (c *blockCache) put(key string, data []byte) {
+	c.mu.Lock()
+	_, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok || int64(len(data)) > c.maxSize {
+		return
+	}
+	// write to a temporary file first, so that readers never see a partial
+	// block
+	tmp, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, werr := tmp.Write(data)
+	if err := tmp.Close(); werr != nil || err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if err := os.Rename(tmp.Name(), c.path(key)); err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok {
+		c.add(key, int64(len(data)))
+		c.evict()
+	}
+}
+
+func newBlockCache(dir string, maxSize int64) (*blockCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &blockCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// add oldest first, so that the most recently used end up at the front
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		} else if strings.HasPrefix(info.Name(), ".tmp-") {
+			// leftover from an interrupted put
+			os.Remove(filepath.Join(dir, info.Name()))
+			continue
+		}
+		c.add(info.Name(), info.Size())
+	}
+	c.evict()
+	return c, nil
+}
+
+// A statReaderAt is a file that can be read at arbitrary offsets, such as a
+// renterutil.PseudoFile.
+type statReaderAt interface {
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// A cachedFile reads a file in fixed-size blocks, consulting a blockCache
+// before downloading from hosts.
+type cachedFile struct {
+	r       statReaderAt
+	cache   *blockCache
+	size    int64
+	modTime time.Time
+	key     string // identifies the file's contents; see metaFileHash
+}
+
+// readBlock reads len(p) bytes at off, which must lie within the block of
+// length blockLen at blockOff. On a cache miss, the whole block is downloaded
+// and cached.
+func (cf *cachedFile) readBlock(p []byte, off, blockOff, blockLen int64, key string) error {
+	if cf.cache.get(key, blockLen, p, off-blockOff) {
+		cacheHits.inc()
+		return nil
+	}
+	cacheMisses.inc()
+	data := make([]byte, blockLen)
+	if _, err := (timedReaderAt{cf.r}).ReadAt(data, blockOff); err != nil && err != io.EOF {
+		return err
+	}
+	cf.cache.put(key, data)
+	copy(p, data[off-blockOff:])
+	return nil
+}
+
+// stale reports whether the file has been modified since cf was created, in
+// which case its key no longer reflects its contents.
+func (cf *cachedFile) stale() bool {
+	stat, err := cf.r.Stat()
+	return err != nil || stat.Size() != cf.size || !stat.ModTime().Equal(cf.modTime)
+}
+
+// ReadAt implements io.ReaderAt.
+func (cf *cachedFile) ReadAt(p []byte, off int64) (int, error) {
+	if cf.stale() {
+		return timedReaderAt{cf.r}.ReadAt(p, off)
+	}
+	var n int
+	for n < len(p) && off < cf.size {
+		block := off / cacheBlockSize
+		blockOff := block * cacheBlockSize
+		blockLen := cf.size - blockOff
+		if blockLen > cacheBlockSize {
+			blockLen = cacheBlockSize
+		}
+		buf := p[n:]
+		if rem := blockOff + blockLen - off; int64(len(buf)) > rem {
+			buf = buf[:rem]
+		}
+		if err := cf.readBlock(buf, off, blockOff, blockLen, cf.key+"-"+strconv.FormatInt(block, 10)); err != nil {
+			return n, err
+		}
+		n += len(buf)
+		off += int64(len(buf))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// metaFileHash returns a hash of the sector slices and size of m. How file
+// data is laid out across slices is up to PseudoFS (and varies with how the
+// file was written), so rather than deriving a key for each range of the file
+// from the slices it occupies, the hash covers them all. Modifying any part
+// of a file thus invalidates all of its cached blocks, but two files with the
+// same hash always have the same contents.
+func metaFileHash(m *renter.MetaFile) []byte {
+	h := sha256.New()
+	for _, shard := range m.Shards {
+		for _, ss := range shard {
+			h.Write(ss.MerkleRoot[:])
+			binary.Write(h, binary.LittleEndian, ss.SegmentIndex)
+			binary.Write(h, binary.LittleEndian, ss.NumSegments)
+		}
+	}
+	binary.Write(h, binary.LittleEndian, m.Filesize)
+	return h.Sum(nil)
+}
+
+// newCachedFile returns a cachedFile for pf, whose metadata is stored in the
+// metafile at metaPath.
+func newCachedFile(pf statReaderAt, metaPath string, cache *blockCache) (*cachedFile, error) {
+	stat, err := pf.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m, err := renter.ReadMetaFile(metaPath)
+	if err != nil {
+		return nil, err
+	}
+	// if the file has unflushed modifications, the metafile on disk doesn't
+	// describe its contents
+	if stat.Size() != m.Filesize || !stat.ModTime().Equal(m.ModTime) {
+		return nil, errors.New("metafile does not match file")
+	}
+	return &cachedFile{
+		r:       pf,
+		cache:   cache,
+		size:    m.Filesize,
+		modTime: m.ModTime,
+		key:     hex.EncodeToString(metaFileHash(m)),
+	}, nil
+}
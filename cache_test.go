@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"lukechampine.com/us/renter"
+)
+
+// A memFile is an in-memory statReaderAt.
+type memFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return memFileInfo{f}, nil
+}
+
+type memFileInfo struct{ f *memFile }
+
+func (fi memFileInfo) Name() string       { return "mem" }
+func (fi memFileInfo) Size() int64        { return int64(len(fi.f.data)) }
+func (fi memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi memFileInfo) ModTime() time.Time { return fi.f.modTime }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+// checkReads reads random, unaligned ranges of cf and compares them to want.
+func checkReads(t *testing.T, cf *cachedFile, want []byte) {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		off := rand.Int63n(int64(len(want)))
+		p := make([]byte, rand.Intn(3*cacheBlockSize))
+		n, err := cf.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		end := off + int64(len(p))
+		if end > int64(len(want)) {
+			end = int64(len(want))
+			if err != io.EOF {
+				t.Fatal("expected EOF when reading past end of file")
+			}
+		}
+		if !bytes.Equal(p[:n], want[off:end]) {
+			t.Fatalf("read of %v bytes at %v returned wrong data", len(p), off)
+		}
+	}
+}
+
+func TestCachedFileUnalignedWrites(t *testing.T) {
+	cache, err := newBlockCache(t.TempDir(), 100*cacheBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a file whose size is not a multiple of the block size
+	data := make([]byte, 3*cacheBlockSize+12345)
+	rand.Read(data)
+	f := &memFile{data: append([]byte(nil), data...), modTime: time.Unix(1, 0)}
+	cf := &cachedFile{r: f, cache: cache, size: int64(len(data)), modTime: f.modTime, key: "v1"}
+	checkReads(t, cf, data)
+	checkReads(t, cf, data) // served from the cache
+
+	// overwrite an unaligned range spanning a block boundary, and append an
+	// unaligned amount of data
+	copy(data[cacheBlockSize-777:], bytes.Repeat([]byte{1}, 2000))
+	data = append(data, bytes.Repeat([]byte{2}, 4321)...)
+	f.data = append([]byte(nil), data...)
+	f.modTime = time.Unix(2, 0)
+
+	// the old cachedFile must not serve stale blocks
+	checkReads(t, cf, data)
+	// nor may a new one, even though the cache still contains the old blocks
+	cf = &cachedFile{r: f, cache: cache, size: int64(len(data)), modTime: f.modTime, key: "v2"}
+	checkReads(t, cf, data)
+	checkReads(t, cf, data)
+}
+
+func TestMetaFileHash(t *testing.T) {
+	m := &renter.MetaFile{
+		MetaIndex: renter.MetaIndex{Filesize: 100, MinShards: 1},
+		Shards: [][]renter.SectorSlice{
+			{{SegmentIndex: 0, NumSegments: 2}},
+			{{SegmentIndex: 0, NumSegments: 2}},
+		},
+	}
+	orig := metaFileHash(m)
+	for _, modify := range []func(){
+		func() { m.Filesize++ },
+		func() { m.Shards[1][0].MerkleRoot[0] ^= 1 },
+		func() { m.Shards[0][0].SegmentIndex++ },
+		func() { m.Shards[0] = append(m.Shards[0], renter.SectorSlice{NumSegments: 1}) },
+	} {
+		modify()
+		if bytes.Equal(metaFileHash(m), orig) {
+			t.Fatal("modifying metafile did not change its hash")
+		}
+		orig = metaFileHash(m)
+	}
+}
+
+func TestBlockCacheGet(t *testing.T) {
+	cache, err := newBlockCache(t.TempDir(), 100*cacheBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello, world")
+	cache.put("k", data)
+	p := make([]byte, 5)
+	if !cache.get("k", int64(len(data)), p, 7) || string(p) != "world" {
+		t.Fatalf("expected cached range, got %q", p)
+	} else if cache.get("k", 100, p, 0) {
+		t.Fatal("expected miss for block of wrong size")
+	}
+
+	// a block truncated on disk is a miss, and can be replaced
+	cache.put("k", data)
+	if err := os.Truncate(cache.path("k"), 3); err != nil {
+		t.Fatal(err)
+	} else if cache.get("k", int64(len(data)), p, 7) {
+		t.Fatal("expected miss for truncated block")
+	}
+	cache.put("k", data)
+	if !cache.get("k", int64(len(data)), p, 0) || string(p) != "hello" {
+		t.Fatalf("expected replaced block, got %q", p)
+	}
+}
@@ -9,10 +9,27 @@ import (
 )
 
 var config struct {
-	MuseAddr  string `toml:"muse_addr"`
-	SHARDAddr string `toml:"shard_addr"`
-	HostSet   string `toml:"host_set"`
-	MinShards int    `toml:"min_shards"`
+	MuseAddr   string `toml:"muse_addr"`
+	SHARDAddr  string `toml:"shard_addr"`
+	HostSet    string `toml:"host_set"`
+	MinShards  int    `toml:"min_shards"`
+	CacheDir   string `toml:"cache_dir"`
+	CacheSize  string `toml:"cache_size"`
+	Readahead  string `toml:"readahead"`
+	JournalDir string `toml:"journal_dir"`
+
+	ServeUser         string  `toml:"serve_user"`
+	ServePassword     string  `toml:"serve_password"`
+	ServeToken        string  `toml:"serve_token"`
+	ServeCacheControl string  `toml:"serve_cache_control"`
+	ServeAccessLog    string  `toml:"serve_access_log"`
+	ServeRateLimit    float64 `toml:"serve_rate_limit"`
+	ServeRateBurst    int     `toml:"serve_rate_burst"`
+	ServeBandwidth    string  `toml:"serve_bandwidth_limit"`
+	ShareSecret       string  `toml:"share_secret"`
+	ShareURL          string  `toml:"share_url"`
+	S3AccessKey       string  `toml:"s3_access_key"`
+	S3SecretKey       string  `toml:"s3_secret_key"`
 }
 
 func loadConfig() error {
@@ -33,5 +50,20 @@ func loadConfig() error {
 	if config.HostSet == "" {
 		config.HostSet = "default"
 	}
+	if config.CacheSize == "" {
+		config.CacheSize = "1GB"
+	}
+	if config.Readahead == "" {
+		config.Readahead = "16MiB"
+	}
+	if config.ServeUser == "" {
+		config.ServeUser = "user"
+	}
+	if config.ServeRateBurst == 0 {
+		config.ServeRateBurst = 20
+	}
+	if config.ShareURL == "" {
+		config.ShareURL = "http://localhost:8080"
+	}
 	return nil
 }
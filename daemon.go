@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// daemonEnv is set in the environment of a daemonized mount process, so that
+// it doesn't try to daemonize again.
+const daemonEnv = "USER_MOUNT_DAEMON"
+
+// runDir returns the directory containing the control sockets, pidfiles, and
+// logs of running mounts.
+func runDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "user")
+	}
+	return filepath.Join(os.TempDir(), "user-"+strconv.Itoa(os.Getuid()))
+}
+
+// controlPaths returns the paths of the control socket, pidfile, and log for
+// the mount at mountDir.
+func controlPaths(mountDir string) (sock, pid, logPath string) {
+	abs, err := filepath.Abs(mountDir)
+	if err != nil {
+		abs = mountDir
+	}
+	h := sha256.Sum256([]byte(abs))
+	base := filepath.Join(runDir(), hex.EncodeToString(h[:8]))
+	return base + ".sock", base + ".pid", base + ".log"
+}
+
+// A mountStatus describes a running mount.
+type mountStatus struct {
+	MetaDirs     []string `json:"metaDirs"`
+	MountDir     string   `json:"mountDir"`
+	PID          int      `json:"pid"`
+	PendingFiles int      `json:"pendingFiles"`
+	PendingBytes int64    `json:"pendingBytes"`
+}
+
+// serveControl listens on the control socket for the mount at mountDir and
+// writes its pidfile. Unmount requests are delivered on unmount, along with a
+// channel on which the result of the unmount should be sent; unmounted should
+// be closed once the filesystem has been unmounted, after which further
+// requests have no effect. The returned function stops the server and removes
+// its files.
+func serveControl(members []*fuseFS, mountDir string, unmount chan<- chan error, unmounted <-chan struct{}) (func(), error) {
+	sockPath, pidPath, _ := controlPaths(mountDir)
+	if err := os.MkdirAll(runDir(), 0700); err != nil {
+		return nil, err
+	}
+	if _, err := controlClient(sockPath).Get("http://unix/status"); err == nil {
+		return nil, errors.Errorf("%v is already mounted", mountDir)
+	}
+	os.Remove(sockPath) // left over from a previous crash
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(pidPath, []byte(strconv.Itoa(os.Getpid())+"\n"), 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	var absMetas []string
+	for _, fs := range members {
+		abs, _ := filepath.Abs(fs.root)
+		absMetas = append(absMetas, abs)
+	}
+	absMount, _ := filepath.Abs(mountDir)
+	status := func() mountStatus {
+		s := mountStatus{
+			MetaDirs: absMetas,
+			MountDir: absMount,
+			PID:      os.Getpid(),
+		}
+		for _, fs := range members {
+			if fs.journal != nil {
+				n, size := fs.journal.Pending()
+				s.PendingFiles += n
+				s.PendingBytes += size
+			}
+		}
+		return s
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(status())
+	})
+	mux.HandleFunc("/flush", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		for _, fs := range members {
+			if fs.journal != nil {
+				if err := fs.journal.Flush(); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(status())
+	})
+	mux.HandleFunc("/unmount", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		result := make(chan error, 1)
+		select {
+		case <-unmounted:
+			// already unmounted; staged files are being uploaded
+			json.NewEncoder(w).Encode(status())
+			return
+		case unmount <- result:
+		default:
+			http.Error(w, "an unmount is already in progress", http.StatusConflict)
+			return
+		}
+		select {
+		case err := <-result:
+			if err != nil {
+				http.Error(w, fmt.Sprintf("could not unmount (%v); close any open files and try again", err), http.StatusConflict)
+				return
+			}
+		case <-unmounted:
+		}
+		json.NewEncoder(w).Encode(status())
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(l)
+	return func() {
+		srv.Close()
+		os.Remove(sockPath)
+		os.Remove(pidPath)
+	}, nil
+}
+
+func controlClient(sockPath string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sockPath)
+			},
+		},
+	}
+}
+
+// controlRequest sends a request to the control socket at sockPath.
+func controlRequest(ctx context.Context, sockPath, method, path string) (mountStatus, error) {
+	var s mountStatus
+	req, err := http.NewRequestWithContext(ctx, method, "http://unix"+path, nil)
+	if err != nil {
+		return s, err
+	}
+	resp, err := controlClient(sockPath).Do(req)
+	if err != nil {
+		return s, errors.New("not mounted")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return s, errors.New(strings.TrimSpace(string(msg)))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&s)
+	return s, err
+}
+
+func printMountStatus(s mountStatus) {
+	fmt.Printf(`Mountpoint:  %v
+Metafolder:  %v
+PID:         %v
+Pending:     %v files (%v)
+`, s.MountDir, strings.Join(s.MetaDirs, ", "), s.PID, s.PendingFiles, filesizeUnits(s.PendingBytes))
+}
+
+// mountstatus displays the status of the mount at mountDir, or of all mounts
+// if mountDir is empty.
+func mountstatus(mountDir string) error {
+	if mountDir != "" {
+		sock, _, _ := controlPaths(mountDir)
+		s, err := controlRequest(context.Background(), sock, http.MethodGet, "/status")
+		if err != nil {
+			return err
+		}
+		printMountStatus(s)
+		return nil
+	}
+	socks, _ := filepath.Glob(filepath.Join(runDir(), "*.sock"))
+	var found bool
+	for _, sock := range socks {
+		s, err := controlRequest(context.Background(), sock, http.MethodGet, "/status")
+		if err != nil {
+			continue
+		}
+		if found {
+			fmt.Println()
+		}
+		printMountStatus(s)
+		found = true
+	}
+	if !found {
+		fmt.Println("No active mounts.")
+	}
+	return nil
+}
+
+// mountflush uploads all staged files of the mount at mountDir.
+func mountflush(mountDir string) error {
+	sock, _, _ := controlPaths(mountDir)
+	if _, err := controlRequest(context.Background(), sock, http.MethodGet, "/status"); err != nil {
+		return err
+	}
+	log.Println("Uploading staged files...")
+	_, err := controlRequest(context.Background(), sock, http.MethodPost, "/flush")
+	return err
+}
+
+// isMounted returns true if a mount at mountDir is responding to requests.
+func isMounted(mountDir string) bool {
+	sock, _, _ := controlPaths(mountDir)
+	_, err := controlRequest(context.Background(), sock, http.MethodGet, "/status")
+	return err == nil
+}
+
+// unmount cleanly unmounts the mount at mountDir, waiting for its staged files
+// to be uploaded. If timeout is nonzero and the mount process has not exited
+// by then, unmount returns an error; the process continues uploading in the
+// background.
+func unmount(mountDir string, timeout time.Duration) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	sock, _, _ := controlPaths(mountDir)
+	s, err := controlRequest(ctx, sock, http.MethodPost, "/unmount")
+	if err != nil {
+		return err
+	}
+	log.Println("Unmounting...")
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			return errors.Errorf("timed out after %v with %v staged files (%v) remaining; the mount process (pid %v) is still uploading them", timeout, s.PendingFiles, filesizeUnits(s.PendingBytes), s.PID)
+		case <-time.After(time.Second):
+		}
+		s, err = controlRequest(ctx, sock, http.MethodGet, "/status")
+		if ctx.Err() != nil {
+			continue
+		} else if err != nil {
+			// control socket is gone; mount process has exited
+			fmt.Println()
+			return nil
+		}
+		fmt.Printf("\rUploading staged files: %v remaining (%v)    ", s.PendingFiles, filesizeUnits(s.PendingBytes))
+	}
+}
+
+// daemonStartTimeout is how long daemonize waits for the mount to start.
+const daemonStartTimeout = 2 * time.Minute
+
+// daemonize starts a copy of the current process in the background, returning
+// once it has mounted mountDir. If the mount doesn't start within
+// daemonStartTimeout, the process is terminated.
+func daemonize(mountDir string) error {
+	sock, _, logPath := controlPaths(mountDir)
+	if err := os.MkdirAll(runDir(), 0700); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	timeout := time.After(daemonStartTimeout)
+	for {
+		select {
+		case err := <-exited:
+			return errors.Errorf("mount process exited (%v); see %v for details", err, logPath)
+		case <-timeout:
+			// SIGTERM, rather than SIGKILL, so that the process unmounts if it
+			// got that far
+			cmd.Process.Signal(syscall.SIGTERM)
+			return errors.Errorf("mount process did not start within %v; see %v for details", daemonStartTimeout, logPath)
+		case <-time.After(100 * time.Millisecond):
+			if _, err := controlRequest(context.Background(), sock, http.MethodGet, "/status"); err == nil {
+				log.Printf("Mounted in background (pid %v). Logs are written to %v.", cmd.Process.Pid, logPath)
+				return nil
+			}
+		}
+	}
+}
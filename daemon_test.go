@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlUnmount(t *testing.T) {
+	os.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	defer os.Unsetenv("XDG_RUNTIME_DIR")
+	mountDir := filepath.Join(t.TempDir(), "mnt")
+	unmountChan := make(chan chan error, 1)
+	unmounted := make(chan struct{})
+	stop, err := serveControl(nil, mountDir, unmountChan, unmounted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if !isMounted(mountDir) {
+		t.Fatal("expected mount to be reported")
+	}
+
+	// a failed unmount is reported to the client
+	go func() {
+		result := <-unmountChan
+		result <- errors.New("device or resource busy")
+	}()
+	if err := unmount(mountDir, time.Minute); err == nil || !strings.Contains(err.Error(), "busy") {
+		t.Fatalf("expected busy error, got %v", err)
+	}
+
+	// if the mount never exits, the timeout applies
+	go func() {
+		result := <-unmountChan
+		result <- nil
+		close(unmounted)
+	}()
+	if err := unmount(mountDir, 1500*time.Millisecond); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	// once the control server stops, the mount is no longer reported
+	stop()
+	if isMounted(mountDir) {
+		t.Fatal("expected mount to be gone")
+	}
+}
@@ -59,7 +59,7 @@ func deleteUnreferencedSectors(contracts []renter.Contract, hkr renter.HostKeyRe
 	var numFiles int
 	var fileSectors int
 	err = filepath.Walk(metaDir, func(path string, info os.FileInfo, _ error) error {
-		if info.IsDir() || !strings.HasSuffix(path, ".usa") {
+		if info.IsDir() || info.Mode()&os.ModeSymlink != 0 || !strings.HasSuffix(path, ".usa") {
 			return nil
 		}
 		m, err := renter.ReadMetaFile(path)
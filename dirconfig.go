@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// dirConfigFile is the name of the file, within a directory of a metafolder,
+// that overrides settings for files in that directory and its subdirectories.
+const dirConfigFile = ".user.toml"
+
+type dirConfig struct {
+	MinShards int `toml:"min_shards"`
+}
+
+// readDirConfig reads the dirConfigFile in dir, if it exists.
+func readDirConfig(dir string) (dirConfig, error) {
+	var dc dirConfig
+	_, err := toml.DecodeFile(filepath.Join(dir, dirConfigFile), &dc)
+	return dc, err
+}
+
+// dirMinShards returns the min_shards setting for files in dir, a
+// slash-separated path relative to root. The setting is taken from the
+// nearest dirConfigFile in dir or its parents; if there is none, def is
+// returned. Since dirConfigFiles may be edited by hand, the setting is
+// validated: it must be positive and, if hosts is nonzero, no greater than
+// hosts.
+func dirMinShards(root, dir string, def, hosts int) (int, error) {
+	for {
+		configPath := filepath.Join(root, filepath.FromSlash(dir), dirConfigFile)
+		dc, err := readDirConfig(filepath.Dir(configPath))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, errors.Wrapf(syscall.EINVAL, "could not read %v: %v", configPath, err)
+		} else if dc.MinShards < 0 {
+			return 0, errors.Wrapf(syscall.EINVAL, "min_shards in %v must be positive", configPath)
+		} else if hosts > 0 && dc.MinShards > hosts {
+			return 0, errors.Wrapf(syscall.EINVAL, "min_shards in %v (%v) exceeds the number of hosts (%v)", configPath, dc.MinShards, hosts)
+		} else if dc.MinShards > 0 {
+			return dc.MinShards, nil
+		}
+		if dir == "" || dir == "." || dir == "/" {
+			return def, nil
+		}
+		dir = path.Dir(dir)
+	}
+}
+
+// setDirMinShards sets the min_shards setting in the dirConfigFile in dir,
+// creating it if necessary. If minShards is 0, the setting is removed, and
+// the file is deleted if no other settings remain.
+func setDirMinShards(dir string, minShards int) error {
+	dc, err := readDirConfig(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not read existing config")
+	}
+	dc.MinShards = minShards
+	configPath := filepath.Join(dir, dirConfigFile)
+	if dc == (dirConfig{}) {
+		if err := os.Remove(configPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	// write to a temporary file first, so that a crash can't leave the
+	// config truncated
+	tmp := filepath.Join(dir, tempName(dirConfigFile))
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	if err := toml.NewEncoder(f).Encode(dc); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, configPath)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/errors"
+)
+
+func TestDirMinShardsXAttr(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "a", "b"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	fs := fileSystem(nil, root, 2)
+	fs.hosts = 6
+
+	tests := []struct {
+		data string
+		code fuse.Status
+	}{
+		{"0", fuse.EINVAL},
+		{"x", fuse.EINVAL},
+		{"7", fuse.EINVAL}, // more than the number of hosts
+		{"6", fuse.OK},
+		{" 3\n", fuse.OK},
+	}
+	for _, test := range tests {
+		if code := fs.SetXAttr("a", xattrMinShards, []byte(test.data), 0, nil); code != test.code {
+			t.Errorf("%q: expected %v, got %v", test.data, test.code, code)
+		}
+	}
+	if code := fs.SetXAttr("a/missing", xattrMinShards, []byte("3"), 0, nil); code.Ok() {
+		t.Error("expected error for nonexistent directory")
+	}
+
+	// the setting is inherited by subdirectories, and removing it restores
+	// the default
+	if n, err := fs.minShardsFor("a/b/file"); err != nil || n != 3 {
+		t.Errorf("expected 3, got %v (%v)", n, err)
+	}
+	if n, err := fs.minShardsFor("file"); err != nil || n != 2 {
+		t.Errorf("expected 2, got %v (%v)", n, err)
+	}
+	if code := fs.RemoveXAttr("a", xattrMinShards, nil); !code.Ok() {
+		t.Fatal(code)
+	}
+	if n, err := fs.minShardsFor("a/b/file"); err != nil || n != 2 {
+		t.Errorf("expected 2, got %v (%v)", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "a", dirConfigFile)); !os.IsNotExist(err) {
+		t.Error("expected config file to be removed")
+	}
+}
+
+func TestDirMinShardsValidation(t *testing.T) {
+	root := t.TempDir()
+	write := func(dir, config string) {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(filepath.Join(root, dir, dirConfigFile), []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("ok", "min_shards = 3\n")
+	write("toomany", "min_shards = 7\n")
+	write("negative", "min_shards = -1\n")
+	write("malformed", "min_shards = \n")
+
+	tests := []struct {
+		dir   string
+		hosts int
+		n     int
+	}{
+		{"ok/sub", 6, 3},
+		{"missing", 6, 2},
+		{"toomany", 0, 7}, // host count unknown
+		{"toomany", 6, 0},
+		{"negative", 6, 0},
+		{"malformed", 6, 0},
+	}
+	for _, test := range tests {
+		n, err := dirMinShards(root, test.dir, 2, test.hosts)
+		if test.n == 0 {
+			if errors.Cause(err) != syscall.EINVAL {
+				t.Errorf("%v: expected EINVAL, got %v (%v)", test.dir, n, err)
+			}
+		} else if err != nil || n != test.n {
+			t.Errorf("%v: expected %v, got %v (%v)", test.dir, test.n, n, err)
+		}
+	}
+
+	// rewriting the config leaves no temporary files behind
+	if err := setDirMinShards(filepath.Join(root, "ok"), 4); err != nil {
+		t.Fatal(err)
+	} else if infos, _ := ioutil.ReadDir(filepath.Join(root, "ok")); len(infos) != 1 {
+		t.Errorf("expected only the config file, got %v entries", len(infos))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/errors"
+	"lukechampine.com/us/renter/renterutil"
+)
+
+// hostErrors maps substrings of error messages to errnos. Errors returned by
+// hosts cross the wire as strings, so there is no more precise way to
+// identify them. Earlier entries take precedence.
+var hostErrors = []struct {
+	substr string
+	status fuse.Status
+}{
+	// contract funds exhausted
+	{"insufficient funds", fuse.Status(syscall.ENOSPC)},
+	{"not enough funds", fuse.Status(syscall.ENOSPC)},
+	{"insufficient renter funds", fuse.Status(syscall.ENOSPC)},
+	{"not enough storage", fuse.Status(syscall.ENOSPC)},
+	{"no space left", fuse.Status(syscall.ENOSPC)},
+	// hosts unreachable or too slow
+	{"timed out", fuse.Status(syscall.ETIMEDOUT)},
+	{"timeout", fuse.Status(syscall.ETIMEDOUT)},
+	{"deadline exceeded", fuse.Status(syscall.ETIMEDOUT)},
+	{"not enough hosts", fuse.Status(syscall.EAGAIN)},
+	{"could not connect", fuse.Status(syscall.EAGAIN)},
+	{"connection refused", fuse.Status(syscall.EAGAIN)},
+	{"connection reset", fuse.Status(syscall.EAGAIN)},
+	{"no route to host", fuse.Status(syscall.EAGAIN)},
+	{"host is unreachable", fuse.Status(syscall.EAGAIN)},
+	{"contract is locked", fuse.Status(syscall.EAGAIN)},
+	// filesystem errors that lost their type along the way
+	{"file exists", fuse.Status(syscall.EEXIST)},
+	{"directory not empty", fuse.Status(syscall.ENOTEMPTY)},
+	{"is a directory", fuse.Status(syscall.EISDIR)},
+	{"not a directory", fuse.Status(syscall.ENOTDIR)},
+	{"permission denied", fuse.EACCES},
+	{"read-only file system", fuse.EROFS},
+}
+
+// errnoFor returns the errno that most precisely describes err, or EIO if
+// there is none.
+func errnoFor(err error) fuse.Status {
+	// errors from the local filesystem (e.g. the metafolder or journal)
+	// carry their own errno; check it first, since os.IsExist also matches
+	// ENOTEMPTY
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		if errno == syscall.ECONNREFUSED || errno == syscall.ECONNRESET || errno == syscall.EHOSTUNREACH || errno == syscall.ENETUNREACH {
+			return fuse.Status(syscall.EAGAIN)
+		}
+		return fuse.Status(errno)
+	}
+	cause := errors.Cause(err)
+	switch {
+	case os.IsNotExist(cause):
+		return fuse.ENOENT
+	case os.IsExist(cause):
+		return fuse.Status(syscall.EEXIST)
+	case os.IsPermission(cause):
+		return fuse.EACCES
+	case cause == renterutil.ErrInvalidFileDescriptor:
+		return fuse.EINVAL
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return fuse.Status(syscall.ETIMEDOUT)
+		}
+		return fuse.Status(syscall.EAGAIN)
+	}
+	msg := strings.ToLower(err.Error())
+	for _, he := range hostErrors {
+		if strings.Contains(msg, he.substr) {
+			return he.status
+		}
+	}
+	return fuse.EIO
+}
+
+// errToStatus converts err to a fuse.Status. Unexpected errors, and errors
+// involving hosts, are logged.
+func errToStatus(op, name string, err error) fuse.Status {
+	if err == nil {
+		return fuse.OK
+	}
+	code := errnoFor(err)
+	switch code {
+	case fuse.EIO, fuse.Status(syscall.ENOSPC), fuse.Status(syscall.EAGAIN), fuse.Status(syscall.ETIMEDOUT):
+		log.Printf("%v %v: %v", op, name, err)
+	}
+	return code
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/errors"
+	"lukechampine.com/us/renter/renterutil"
+)
+
+// timeoutError is a net.Error that reports a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o deadline reached" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrnoFor(t *testing.T) {
+	tests := []struct {
+		err  error
+		code fuse.Status
+	}{
+		// typed errors
+		{os.ErrNotExist, fuse.ENOENT},
+		{&os.PathError{Op: "open", Path: "foo", Err: syscall.ENOENT}, fuse.ENOENT},
+		{errors.Wrap(os.ErrNotExist, "could not open"), fuse.ENOENT},
+		{os.ErrExist, fuse.Status(syscall.EEXIST)},
+		{os.ErrPermission, fuse.EACCES},
+		{renterutil.ErrInvalidFileDescriptor, fuse.EINVAL},
+
+		// errnos, including those wrapped by other errors
+		{syscall.ENOTEMPTY, fuse.Status(syscall.ENOTEMPTY)}, // not EEXIST, despite os.IsExist
+		{&os.PathError{Op: "open", Path: "foo", Err: syscall.EPERM}, fuse.EPERM},
+		{&os.PathError{Op: "write", Path: "foo", Err: syscall.ENOSPC}, fuse.Status(syscall.ENOSPC)},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: &os.SyscallError{Syscall: "connect", Err: syscall.ECONNREFUSED}}, fuse.Status(syscall.EAGAIN)},
+		{errors.Wrap(syscall.ECONNRESET, "read failed"), fuse.Status(syscall.EAGAIN)},
+		{syscall.EHOSTUNREACH, fuse.Status(syscall.EAGAIN)},
+		{syscall.ENETUNREACH, fuse.Status(syscall.EAGAIN)},
+
+		// network errors
+		{timeoutError{}, fuse.Status(syscall.ETIMEDOUT)},
+		{errors.Wrap(timeoutError{}, "could not read sector"), fuse.Status(syscall.ETIMEDOUT)},
+		{&net.DNSError{Err: "no such host", Name: "example"}, fuse.Status(syscall.EAGAIN)},
+
+		// host errors, which arrive as strings; matching is case-insensitive
+		// and finds the substring anywhere in the message
+		{errors.New("host rejected revision: Insufficient Funds"), fuse.Status(syscall.ENOSPC)},
+		{errors.New("not enough funds remaining in contract"), fuse.Status(syscall.ENOSPC)},
+		{errors.New("insufficient renter funds"), fuse.Status(syscall.ENOSPC)},
+		{errors.New("host has not enough storage"), fuse.Status(syscall.ENOSPC)},
+		{errors.New("write: no space left on device"), fuse.Status(syscall.ENOSPC)},
+		{errors.New("RPC timed out"), fuse.Status(syscall.ETIMEDOUT)},
+		{errors.New("read timeout"), fuse.Status(syscall.ETIMEDOUT)},
+		{errors.New("context deadline exceeded"), fuse.Status(syscall.ETIMEDOUT)},
+		{errors.New("not enough hosts to download (2/3)"), fuse.Status(syscall.EAGAIN)},
+		{errors.New("could not connect to host"), fuse.Status(syscall.EAGAIN)},
+		{errors.New("dial tcp 1.2.3.4:9982: connection refused"), fuse.Status(syscall.EAGAIN)},
+		{errors.New("read: connection reset by peer"), fuse.Status(syscall.EAGAIN)},
+		{errors.New("no route to host"), fuse.Status(syscall.EAGAIN)},
+		{errors.New("host is unreachable"), fuse.Status(syscall.EAGAIN)},
+		{errors.New("contract is locked by another party"), fuse.Status(syscall.EAGAIN)},
+		{errors.New("mkdir foo: file exists"), fuse.Status(syscall.EEXIST)},
+		{errors.New("remove foo: directory not empty"), fuse.Status(syscall.ENOTEMPTY)},
+		{errors.New("read foo: is a directory"), fuse.Status(syscall.EISDIR)},
+		{errors.New("open foo/bar: not a directory"), fuse.Status(syscall.ENOTDIR)},
+		{errors.New("open foo: permission denied"), fuse.EACCES},
+		{errors.New("open foo: read-only file system"), fuse.EROFS},
+
+		// earlier entries take precedence
+		{errors.New("insufficient funds; request timed out"), fuse.Status(syscall.ENOSPC)},
+		{errors.New("timed out: not enough hosts"), fuse.Status(syscall.ETIMEDOUT)},
+
+		// anything else
+		{errors.New("merkle proof invalid"), fuse.EIO},
+		{errors.New("funds"), fuse.EIO},
+	}
+	for _, test := range tests {
+		if code := errnoFor(test.err); code != test.code {
+			t.Errorf("%v: expected %v, got %v", test.err, test.code, code)
+		}
+	}
+}
+
+func TestErrToStatus(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	if code := errToStatus("Read", "foo", nil); code != fuse.OK {
+		t.Errorf("expected OK, got %v", code)
+	}
+	tests := []struct {
+		err  error
+		code fuse.Status
+	}{
+		{os.ErrNotExist, fuse.ENOENT},
+		{errors.New("insufficient funds"), fuse.Status(syscall.ENOSPC)},
+		{errors.New("not enough hosts"), fuse.Status(syscall.EAGAIN)},
+		{timeoutError{}, fuse.Status(syscall.ETIMEDOUT)},
+		{errors.New("something unexpected"), fuse.EIO},
+	}
+	for _, test := range tests {
+		if code := errToStatus("Read", "foo", test.err); code != test.code {
+			t.Errorf("%v: expected %v, got %v", test.err, test.code, code)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"lukechampine.com/us/renter"
+)
+
+// metaFileETag returns a strong ETag for the contents of m, derived from the
+// Merkle roots of its sectors. Since the roots commit to the (encrypted)
+// data, two files with the same tag have the same contents. The tag
+// deliberately does not resemble an MD5 hash, since it isn't one.
+func metaFileETag(m *renter.MetaFile) string {
+	var chunks int
+	for _, shard := range m.Shards {
+		if len(shard) > chunks {
+			chunks = len(shard)
+		}
+	}
+	return `"` + hex.EncodeToString(metaFileHash(m)[:16]) + "-" + strconv.Itoa(chunks) + `"`
+}
+
+// metaFileHosts returns the short keys of the hosts storing m.
+func metaFileHosts(m *renter.MetaFile) []string {
+	hosts := make([]string, len(m.Hosts))
+	for i, hostKey := range m.Hosts {
+		hosts[i] = hostKey.ShortKey()
+	}
+	return hosts
+}
+
+// maxETagCacheEntries is the maximum number of ETags cached by an etagCache.
+const maxETagCacheEntries = 10000
+
+// An etagCache caches the ETags and hosts of metafiles, so that they need not
+// be read on every request. Entries are invalidated when the metafile
+// changes.
+type etagCache struct {
+	// read returns the ETag and hosts of a metafile; if nil, they are
+	// computed by metaFileETag and metaFileHosts.
+	read func(metaPath string) (string, []string, error)
+
+	mu   sync.Mutex
+	tags map[string]etagEntry
+}
+
+type etagEntry struct {
+	modTime time.Time
+	size    int64
+	etag    string
+	hosts   []string
+}
+
+// lookup returns the ETag and hosts of the metafile at metaPath, or false if
+// it can't be read.
+func (ec *etagCache) lookup(metaPath string) (string, []string, bool) {
+	stat, err := os.Stat(metaPath)
+	if err != nil {
+		return "", nil, false
+	}
+	ec.mu.Lock()
+	e, ok := ec.tags[metaPath]
+	ec.mu.Unlock()
+	if ok && e.modTime.Equal(stat.ModTime()) && e.size == stat.Size() {
+		return e.etag, e.hosts, true
+	}
+	read := ec.read
+	if read == nil {
+		read = readMetaFileETag
+	}
+	etag, hosts, err := read(metaPath)
+	if err != nil {
+		return "", nil, false
+	}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.tags == nil {
+		ec.tags = make(map[string]etagEntry)
+	}
+	if _, ok := ec.tags[metaPath]; !ok && len(ec.tags) >= maxETagCacheEntries {
+		// evict an arbitrary entry; recomputing a tag is cheap enough that
+		// tracking recency isn't worth it
+		for k := range ec.tags {
+			delete(ec.tags, k)
+			break
+		}
+	}
+	ec.tags[metaPath] = etagEntry{
+		modTime: stat.ModTime(),
+		size:    stat.Size(),
+		etag:    etag,
+		hosts:   hosts,
+	}
+	return etag, hosts, true
+}
+
+func readMetaFileETag(metaPath string) (string, []string, error) {
+	m, err := renter.ReadMetaFile(metaPath)
+	if err != nil {
+		return "", nil, err
+	}
+	return metaFileETag(m), metaFileHosts(m), nil
+}
+
+// An etagHandler sets the ETag and Cache-Control headers of responses for
+// files before passing the request to the underlying handler. Since
+// http.FileServer consults the ETag header when evaluating If-None-Match,
+// If-Match, and If-Range, conditional requests are then handled for free.
+// The file's hosts are noted for the access log.
+type etagHandler struct {
+	h            http.Handler
+	root         string
+	cacheControl string // may be empty
+	tags         etagCache
+}
+
+// ServeHTTP implements http.Handler.
+func (eh *etagHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		metaPath := filepath.Join(eh.root, filepath.FromSlash(path.Clean("/"+req.URL.Path))) + metafileExt
+		if etag, hosts, ok := eh.tags.lookup(metaPath); ok {
+			noteHosts(req, hosts)
+			w.Header().Set("ETag", etag)
+			if eh.cacheControl != "" {
+				w.Header().Set("Cache-Control", eh.cacheControl)
+			}
+		}
+	}
+	eh.h.ServeHTTP(w, req)
+}
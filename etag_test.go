@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testETag returns an ETag derived from the contents of metaPath, standing in
+// for metaFileETag, along with a fixed set of hosts.
+func testETag(metaPath string) (string, []string, error) {
+	data, err := ioutil.ReadFile(metaPath)
+	if err != nil {
+		return "", nil, err
+	}
+	h := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(h[:8]) + `"`, []string{"host1", "host2"}, nil
+}
+
+func TestETagHandler(t *testing.T) {
+	// serve plain files, alongside fake metafiles
+	root := t.TempDir()
+	write := func(name, contents string) {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("file", "hello, world")
+	write("file"+metafileExt, "v1")
+	eh := &etagHandler{
+		h:            http.FileServer(http.Dir(root)),
+		root:         root,
+		cacheControl: "max-age=60",
+		tags:         etagCache{read: testETag},
+	}
+	get := func(headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/file", nil)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		eh.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get()
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("unexpected response %v, ETag %q", rec.Code, etag)
+	} else if cc := rec.Header().Get("Cache-Control"); cc != "max-age=60" {
+		t.Errorf("wrong Cache-Control %q", cc)
+	}
+
+	// If-None-Match
+	if rec := get("If-None-Match", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("matching If-None-Match: expected 304, got %v", rec.Code)
+	}
+	if rec := get("If-None-Match", `"other"`); rec.Code != http.StatusOK {
+		t.Errorf("non-matching If-None-Match: expected 200, got %v", rec.Code)
+	}
+
+	// If-Range
+	if rec := get("Range", "bytes=0-4", "If-Range", etag); rec.Code != http.StatusPartialContent || rec.Body.String() != "hello" {
+		t.Errorf("matching If-Range: expected 206 %q, got %v %q", "hello", rec.Code, rec.Body.String())
+	}
+	if rec := get("Range", "bytes=0-4", "If-Range", `"other"`); rec.Code != http.StatusOK || rec.Body.String() != "hello, world" {
+		t.Errorf("non-matching If-Range: expected full response, got %v %q", rec.Code, rec.Body.String())
+	}
+
+	// modifying the metafile changes the tag
+	write("file"+metafileExt, "v2, which is longer")
+	if rec := get("If-None-Match", etag); rec.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match: expected 200, got %v", rec.Code)
+	} else if rec.Header().Get("ETag") == etag {
+		t.Error("expected new ETag")
+	}
+
+	// files without metafiles have no tag
+	write("plain", "no metafile")
+	req := httptest.NewRequest(http.MethodGet, "/plain", nil)
+	rec = httptest.NewRecorder()
+	eh.ServeHTTP(rec, req)
+	if rec.Header().Get("ETag") != "" || rec.Header().Get("Cache-Control") != "" {
+		t.Error("expected no caching headers for file without a metafile")
+	}
+}
+
+func TestETagCacheBound(t *testing.T) {
+	dir := t.TempDir()
+	var reads int
+	ec := etagCache{read: func(metaPath string) (string, []string, error) {
+		reads++
+		return testETag(metaPath)
+	}}
+	n := maxETagCacheEntries + 10
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, strconv.Itoa(i)+metafileExt)
+		if err := ioutil.WriteFile(paths[i], []byte(strconv.Itoa(i)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, ok := ec.lookup(paths[i]); !ok {
+			t.Fatal("lookup failed")
+		}
+	}
+	if len(ec.tags) > maxETagCacheEntries {
+		t.Fatalf("cache has %v entries", len(ec.tags))
+	}
+
+	// cached entries are not reread unless modified
+	reads = 0
+	var cached string
+	for p := range ec.tags {
+		cached = p
+		break
+	}
+	ec.lookup(cached)
+	if reads != 0 {
+		t.Error("expected cached entry to be used")
+	}
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(cached, future, future)
+	ec.lookup(cached)
+	if reads != 1 {
+		t.Error("expected modified entry to be reread")
+	}
+}
@@ -2,59 +2,370 @@ package main
 
 import (
 	"bufio"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
 	"github.com/pkg/errors"
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/renter/renterutil"
 )
 
-func mount(hosts *renterutil.HostSet, metaDir, mountDir string, minShards int) error {
-	pfs := renterutil.NewFileSystem(metaDir, hosts)
-	nfs := pathfs.NewPathNodeFs(fileSystem(pfs, minShards), nil)
+// mountOptions are the settings shared by each metafolder in a mount.
+type mountOptions struct {
+	minShards  int
+	cache      *blockCache
+	readahead  int64  // in bytes
+	journalDir string // base directory; see journalDir
+	noJournal  bool
+	union      bool
+	metrics    string // address to serve metrics on; empty disables
+	trace      bool   // log each FUSE operation
+	daemon     bool   // running in the background; see daemonize
+}
+
+func mount(contracts []renter.Contract, hkr renter.HostKeyResolver, sources []mountSource, mountDir string, opts mountOptions) error {
+	currentHeight, err := getCurrentHeight()
+	if err != nil {
+		return errors.Wrap(err, "could not get current height")
+	}
+	capacity := newCapacityEstimate(contracts, hkr, opts.minShards, currentHeight)
+
+	// each metafolder gets its own PseudoFS, but they share a HostSet, since
+	// a contract can only be locked by one session at a time
+	if opts.metrics != "" {
+		hkr = meteredHKR{hkr}
+	}
+	hs := renterutil.NewHostSet(hkr, currentHeight)
+	hs.SetOnConnect(capacity.onConnect)
+	for _, c := range contracts {
+		hs.AddHost(c)
+	}
+	// querying hosts is slow, so don't wait for it; StatFs reports zero free
+	// space until the first estimates arrive
+	capacity.query()
+	members := make([]*fuseFS, 0, len(sources))
+	for _, src := range sources {
+		pfs := renterutil.NewFileSystem(src.metaDir, hs)
+		fs := fileSystem(pfs, src.metaDir, opts.minShards)
+		fs.cache = opts.cache
+		fs.readahead = (opts.readahead + cacheBlockSize - 1) / cacheBlockSize // round up
+		fs.hosts = len(contracts)
+		fs.capacity = capacity
+		if !opts.noJournal {
+			var err error
+			fs.journal, err = newJournal(journalDir(opts.journalDir, src.metaDir), pfs, src.metaDir)
+			if err != nil {
+				closeMembers(members, hs)
+				return errors.Wrapf(err, "could not open journal for %v", src.metaDir)
+			}
+		}
+		members = append(members, fs)
+	}
+	var root pathfs.FileSystem = members[0]
+	if len(members) > 1 {
+		root = newOverlayFS(sources, members, opts.union)
+	}
+	if opts.metrics != "" || opts.trace {
+		root = &tracedFS{FileSystem: root, trace: opts.trace}
+	}
+	if opts.metrics != "" {
+		if err := serveMetrics(opts.metrics); err != nil {
+			closeMembers(members, hs)
+			return errors.Wrap(err, "could not serve metrics")
+		}
+		log.Printf("Serving metrics on http://%v/metrics", opts.metrics)
+	}
+
+	nfs := pathfs.NewPathNodeFs(root, nil)
 	server, _, err := nodefs.MountRoot(mountDir, nfs.Root(), nil)
 	if err != nil {
+		closeMembers(members, hs)
 		return errors.Wrap(err, "could not mount")
 	}
 	log.Println("Mounted!")
-	go server.Serve()
+	serveDone := make(chan struct{})
+	go func() {
+		server.Serve()
+		close(serveDone)
+	}()
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
-	<-sigChan
-	log.Println("Unmounting... (cached data is being uploaded, don't kill this process!)")
-	if err := pfs.Close(); err != nil {
-		log.Println("Error during close:", err)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	// unmount requests from the control socket are delivered separately from
+	// signals, so that repeating one can't abort the shutdown
+	unmountChan := make(chan chan error, 1)
+	unmounted := make(chan struct{})
+	stop, controlErr := serveControl(members, mountDir, unmountChan, unmounted)
+	if controlErr != nil {
+		controlErr = errors.Wrap(controlErr, "could not start control server")
+		log.Println(controlErr)
+		if opts.daemon {
+			// a daemon can't be unmounted cleanly without the control socket,
+			// and its parent can't tell that it started, so give up
+			unmountChan <- make(chan error, 1)
+		}
+	} else {
+		defer stop()
 	}
-	return server.Unmount()
+	for {
+		var reason string
+		var result chan<- error // where to report the outcome, if requested
+		select {
+		case sig := <-sigChan:
+			reason = fmt.Sprintf("Received %v", sig)
+		case result = <-unmountChan:
+			reason = "Unmount requested"
+		case <-serveDone:
+			log.Println("Filesystem was unmounted externally.")
+		}
+		if reason != "" {
+			log.Printf("%v, unmounting...", reason)
+			err := server.Unmount()
+			if result != nil {
+				result <- err
+			}
+			if err != nil {
+				log.Printf("Could not unmount (%v); close any open files and try again.", err)
+				continue
+			}
+			<-serveDone
+		}
+		break
+	}
+	close(unmounted)
+	if err := shutdown(members, hs, sigChan); err != nil {
+		return err
+	}
+	if opts.daemon {
+		return controlErr
+	}
+	return nil
 }
 
-func errToStatus(op, name string, err error) fuse.Status {
-	if err == nil {
-		return fuse.OK
-	} else if cause := errors.Cause(err); os.IsNotExist(cause) {
-		return fuse.ENOENT
-	} else if cause == renterutil.ErrInvalidFileDescriptor {
-		return fuse.EINVAL
+// shutdown uploads any data staged in the members' journals, then closes the
+// HostSet they share. If a signal arrives before the upload completes,
+// shutdown returns an error; staged files remain in the journal and will be
+// uploaded by the next mount.
+//
+// Written files are synced when closed (see metaFSFile.Flush), so once the
+// filesystem is unmounted, no member's PseudoFS holds any buffered data, and
+// hs can be closed without closing each PseudoFS.
+func shutdown(members []*fuseFS, hs *renterutil.HostSet, sigChan <-chan os.Signal) error {
+	var journals []*journal
+	for _, fs := range members {
+		if fs.journal != nil {
+			journals = append(journals, fs.journal)
+		}
+	}
+	errChan := make(chan error, len(journals))
+	for _, j := range journals {
+		go func(j *journal) { errChan <- j.Flush() }(j)
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var flushErr error
+	for remaining := len(journals); remaining > 0; {
+		var n int
+		var size int64
+		for _, j := range journals {
+			jn, jsize := j.Pending()
+			n, size = n+jn, size+jsize
+		}
+		if n > 0 {
+			fmt.Printf("\rUploading staged files: %v remaining (%v)    ", n, filesizeUnits(size))
+		}
+		select {
+		case err := <-errChan:
+			remaining--
+			if err != nil {
+				fmt.Println()
+				log.Println(err)
+				flushErr = err
+			} else if remaining == 0 && n > 0 {
+				fmt.Println()
+			}
+		case <-ticker.C:
+		case sig := <-sigChan:
+			fmt.Println()
+			return errors.Errorf("received %v; %v staged files will be uploaded on the next mount", sig, n)
+		}
+	}
+	closeMembers(members, hs)
+	return flushErr
+}
+
+// closeMembers closes the journals of each member, and then the HostSet they
+// share.
+func closeMembers(members []*fuseFS, hs *renterutil.HostSet) {
+	for _, fs := range members {
+		if fs.journal != nil {
+			fs.journal.Close()
+		}
 	}
-	log.Printf("%v %v: %v", op, name, err)
-	return fuse.EIO
+	hs.Close()
 }
 
 type fuseFS struct {
 	pathfs.FileSystem
 	pfs       *renterutil.PseudoFS
+	root      string
 	minShards int
+	hosts     int               // number of contracts; 0 if unknown
+	capacity  *capacityEstimate // may be nil
+	cache     *blockCache       // may be nil
+	readahead int64             // in blocks
+	journal   *journal          // may be nil
+
+	statMu   sync.Mutex
+	used     uint64
+	lastStat time.Time
+
+	handleMu sync.Mutex
+	handles  map[string]*openHandle
+}
+
+// An openHandle tracks the open handles of an uploaded file. Closing a file
+// rewrites its metafile, so metadata changes made while the file is open are
+// deferred until its last handle is released.
+type openHandle struct {
+	name  string
+	refs  int
+	mtime *time.Time // pending modification time, if any
+}
+
+// openHandle registers a new handle for name.
+func (fs *fuseFS) openHandle(name string) *openHandle {
+	fs.handleMu.Lock()
+	defer fs.handleMu.Unlock()
+	h, ok := fs.handles[name]
+	if !ok {
+		h = &openHandle{name: name}
+		fs.handles[name] = h
+	}
+	h.refs++
+	return h
+}
+
+// releaseHandle releases a handle, applying any pending metadata changes if
+// it was the last one.
+func (fs *fuseFS) releaseHandle(h *openHandle) {
+	fs.handleMu.Lock()
+	h.refs--
+	if h.refs > 0 {
+		fs.handleMu.Unlock()
+		return
+	}
+	if fs.handles[h.name] == h {
+		delete(fs.handles, h.name)
+	}
+	name, mtime := h.name, h.mtime
+	fs.handleMu.Unlock()
+	if mtime != nil {
+		if err := setModTime(fs.pfs, fs.root, name, *mtime); err != nil {
+			log.Printf("Could not set modification time of %v: %v", name, err)
+		}
+	}
+}
+
+// handleName returns the current name of the file underlying h.
+func (fs *fuseFS) handleName(h *openHandle) string {
+	fs.handleMu.Lock()
+	defer fs.handleMu.Unlock()
+	return h.name
+}
+
+// pendingModTime returns the modification time set on name while it was
+// open, if any.
+func (fs *fuseFS) pendingModTime(name string) *time.Time {
+	fs.handleMu.Lock()
+	defer fs.handleMu.Unlock()
+	if h, ok := fs.handles[name]; ok {
+		return h.mtime
+	}
+	return nil
+}
+
+// renameHandles updates the handles of oldName, and of any files within it,
+// after a rename.
+func (fs *fuseFS) renameHandles(oldName, newName string) {
+	fs.handleMu.Lock()
+	defer fs.handleMu.Unlock()
+	var renamed []*openHandle
+	for name, h := range fs.handles {
+		if name == oldName || strings.HasPrefix(name, oldName+"/") {
+			delete(fs.handles, name)
+			h.name = newName + strings.TrimPrefix(name, oldName)
+			renamed = append(renamed, h)
+		}
+	}
+	for _, h := range renamed {
+		fs.handles[h.name] = h
+	}
+}
+
+// symlinkPath returns the path of the symlink entry for name.
+func (fs *fuseFS) symlinkPath(name string) string {
+	return filepath.Join(fs.root, name+symlinkExt)
+}
+
+// symlinkStat returns the stat of the symlink entry for name, if it exists.
+// Since an entry contains only its target, its size is that of the target.
+func (fs *fuseFS) symlinkStat(name string) (os.FileInfo, bool) {
+	stat, err := os.Lstat(fs.symlinkPath(name))
+	return stat, err == nil && stat.Mode().IsRegular()
 }
 
 // GetAttr implements pathfs.FileSystem.
 func (fs *fuseFS) GetAttr(name string, _ *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if lstat, ok := fs.symlinkStat(name); ok {
+		attr := &fuse.Attr{
+			Size:  uint64(lstat.Size()),
+			Mode:  fuse.S_IFLNK | 0777,
+			Owner: *fuse.CurrentOwner(),
+		}
+		if sys, ok := lstat.Sys().(*syscall.Stat_t); ok {
+			attr.Owner = fuse.Owner{Uid: sys.Uid, Gid: sys.Gid}
+		}
+		mtime := lstat.ModTime()
+		attr.SetTimes(&mtime, &mtime, &mtime)
+		return attr, fuse.OK
+	}
+	if e, stat, ok := fs.staged(name); ok {
+		attr := &fuse.Attr{
+			Size:  uint64(stat.Size()),
+			Mode:  fuse.S_IFREG | uint32(e.Mode.Perm()),
+			Owner: *fuse.CurrentOwner(),
+		}
+		if e.UID != nil {
+			attr.Uid = *e.UID
+		}
+		if e.GID != nil {
+			attr.Gid = *e.GID
+		}
+		mtime := stat.ModTime()
+		if !e.ModTime.IsZero() {
+			mtime = e.ModTime
+		}
+		attr.SetTimes(&mtime, &mtime, &mtime)
+		return attr, fuse.OK
+	}
 	stat, err := fs.pfs.Stat(name)
 	if err != nil {
 		return nil, errToStatus("GetAttr", name, err)
@@ -65,68 +376,289 @@ func (fs *fuseFS) GetAttr(name string, _ *fuse.Context) (*fuse.Attr, fuse.Status
 	} else {
 		mode = fuse.S_IFREG
 	}
-	return &fuse.Attr{
+	attr := &fuse.Attr{
 		Size:  uint64(stat.Size()),
 		Mode:  mode | uint32(stat.Mode()),
-		Mtime: uint64(stat.ModTime().Unix()),
-	}, fuse.OK
+		Owner: *fuse.CurrentOwner(),
+	}
+	// we don't track access times, and the metafile itself is modified
+	// whenever the file's metadata changes, so use its mtime as the ctime
+	mtime, ctime := stat.ModTime(), stat.ModTime()
+	if pending := fs.pendingModTime(name); pending != nil {
+		mtime = *pending
+	}
+	if mstat, err := os.Stat(fs.metaPath(name, stat.IsDir())); err == nil {
+		ctime = mstat.ModTime()
+		if sys, ok := mstat.Sys().(*syscall.Stat_t); ok {
+			attr.Owner = fuse.Owner{Uid: sys.Uid, Gid: sys.Gid}
+		}
+	}
+	attr.SetTimes(&mtime, &mtime, &ctime)
+	return attr, fuse.OK
+}
+
+// staged reports whether name is staged in the journal.
+func (fs *fuseFS) staged(name string) (*journalEntry, os.FileInfo, bool) {
+	if fs.journal == nil {
+		return nil, nil, false
+	}
+	return fs.journal.Staged(name)
+}
+
+// exists reports whether name exists. Unlike GetAttr, it does not open the
+// file's metafile.
+func (fs *fuseFS) exists(name string) bool {
+	if _, _, ok := fs.staged(name); ok {
+		return true
+	} else if _, ok := fs.symlinkStat(name); ok {
+		return true
+	}
+	_, err := os.Stat(fs.metaPath(name, false))
+	return err == nil || fs.isDir(name)
+}
+
+// isDir reports whether name is a directory.
+func (fs *fuseFS) isDir(name string) bool {
+	stat, err := os.Stat(fs.metaPath(name, true))
+	return err == nil && stat.IsDir()
+}
+
+// minShardsFor returns the minimum number of shards for a new file named
+// name, which may be overridden by a dirConfigFile in any of its parent
+// directories.
+func (fs *fuseFS) minShardsFor(name string) (int, error) {
+	return dirMinShards(fs.root, path.Dir(name), fs.minShards, fs.hosts)
+}
+
+// metaPath returns the path of the metafile (or, for directories, the
+// metafolder) underlying name.
+func (fs *fuseFS) metaPath(name string, isDir bool) string {
+	if isDir {
+		return filepath.Join(fs.root, name)
+	}
+	return filepath.Join(fs.root, name+metafileExt)
 }
 
 // OpenDir implements pathfs.FileSystem.
 func (fs *fuseFS) OpenDir(name string, _ *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
-	dir, err := fs.pfs.Open(name)
+	files, err := readDir(fs.pfs, fs.root, name)
 	if err != nil {
 		return nil, errToStatus("OpenDir", name, err)
 	}
-	defer dir.Close()
-	files, err := dir.Readdir(-1)
-	if err != nil {
-		return nil, errToStatus("OpenDir", name, err)
+	// symlinks are not metafiles, so list them separately
+	symlinks := make(map[string]bool)
+	if infos, err := ioutil.ReadDir(fs.metaPath(name, true)); err == nil {
+		for _, info := range infos {
+			if info.Mode().IsRegular() && strings.HasSuffix(info.Name(), symlinkExt) {
+				symlinks[strings.TrimSuffix(info.Name(), symlinkExt)] = true
+			}
+		}
+	}
+	// likewise for staged files
+	staged := make(map[string]bool)
+	if fs.journal != nil {
+		for _, child := range fs.journal.Children(name) {
+			staged[child] = true
+		}
 	}
-	entries := make([]fuse.DirEntry, len(files))
-	for i, f := range files {
+	entries := make([]fuse.DirEntry, 0, len(files)+len(symlinks)+len(staged))
+	for _, f := range files {
 		name := f.Name()
+		if symlinks[name] || staged[name] {
+			continue
+		}
 		mode := uint32(f.Mode())
 		if f.IsDir() {
 			mode |= fuse.S_IFDIR
 		} else {
 			mode |= fuse.S_IFREG
 		}
-		entries[i] = fuse.DirEntry{
+		entries = append(entries, fuse.DirEntry{
 			Name: name,
 			Mode: mode,
-		}
+		})
+	}
+	for name := range symlinks {
+		entries = append(entries, fuse.DirEntry{
+			Name: name,
+			Mode: fuse.S_IFLNK | 0777,
+		})
+	}
+	for name := range staged {
+		entries = append(entries, fuse.DirEntry{
+			Name: name,
+			Mode: fuse.S_IFREG,
+		})
 	}
 	return entries, fuse.OK
 }
 
+// Symlink implements pathfs.FileSystem.
+func (fs *fuseFS) Symlink(value string, linkName string, _ *fuse.Context) (code fuse.Status) {
+	if _, code := fs.GetAttr(linkName, nil); code == fuse.OK {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if err := writeSymlinkEntry(value, filepath.Join(fs.root, linkName)); err != nil {
+		return errToStatus("Symlink", linkName, err)
+	}
+	return fuse.OK
+}
+
+// Readlink implements pathfs.FileSystem.
+func (fs *fuseFS) Readlink(name string, _ *fuse.Context) (string, fuse.Status) {
+	if _, ok := fs.symlinkStat(name); !ok {
+		if _, code := fs.GetAttr(name, nil); code != fuse.OK {
+			return "", code
+		}
+		return "", fuse.EINVAL // not a symlink
+	}
+	target, err := readSymlinkEntry(fs.symlinkPath(name))
+	if err != nil {
+		return "", errToStatus("Readlink", name, err)
+	}
+	return target, fuse.OK
+}
+
 // Open implements pathfs.FileSystem.
 func (fs *fuseFS) Open(name string, flags uint32, _ *fuse.Context) (file nodefs.File, code fuse.Status) {
 	flags &= fuse.O_ANYWRITE | uint32(os.O_APPEND)
+	if fs.journal != nil {
+		if f, err := fs.journal.Open(name, int(flags)); err != nil {
+			return nil, errToStatus("Open", name, err)
+		} else if f != nil {
+			return f, fuse.OK
+		} else if flags&fuse.O_ANYWRITE != 0 {
+			// writes must go through the journal, so the file is staged
+			// once it's modified
+			pf, err := fs.pfs.OpenFile(name, os.O_RDONLY, 0, 0)
+			if err != nil {
+				return nil, errToStatus("Open", name, err)
+			}
+			return &unstagedFile{
+				metaFSFile: &metaFSFile{
+					File: nodefs.NewDefaultFile(),
+					fs:   fs,
+					h:    fs.openHandle(name),
+					pf:   pf,
+					r:    fs.reader(name, pf),
+				},
+				flags: int(flags),
+			}, fuse.OK
+		}
+	}
 	pf, err := fs.pfs.OpenFile(name, int(flags), 0, fs.minShards)
 	if err != nil {
 		return nil, errToStatus("Open", name, err)
 	}
-	return &metaFSFile{
+	f := &metaFSFile{
 		File: nodefs.NewDefaultFile(),
+		fs:   fs,
+		h:    fs.openHandle(name),
 		pf:   pf,
-	}, fuse.OK
+	}
+	if flags&fuse.O_ANYWRITE == 0 {
+		f.r = fs.reader(name, pf)
+	}
+	return f, fuse.OK
+}
+
+// reader returns an io.ReaderAt for pf that uses the cache and readahead
+// settings of fs, or nil if neither is enabled.
+func (fs *fuseFS) reader(name string, pf *renterutil.PseudoFile) io.ReaderAt {
+	var r io.ReaderAt
+	if fs.cache != nil {
+		// if the file can't be cached (e.g. because it is being written),
+		// fall back to reading from hosts directly
+		if cf, err := newCachedFile(pf, fs.metaPath(name, false), fs.cache); err == nil {
+			r = cf
+		}
+	}
+	if fs.readahead > 0 {
+		stat, err := pf.Stat()
+		if err != nil {
+			return r
+		} else if r == nil {
+			r = timedReaderAt{pf}
+		}
+		r = newReadaheadFile(r, stat.Size(), fs.readahead)
+	}
+	return r
+}
+
+// stage stages the uploaded file name, so that it can be modified, and opens
+// the staged file with flags. Unless truncate is set, the file's contents are
+// downloaded into the journal.
+func (fs *fuseFS) stage(name string, flags int, truncate bool) (nodefs.File, error) {
+	stat, err := fs.pfs.Stat(name)
+	if err != nil {
+		return nil, err
+	} else if stat.IsDir() {
+		return nil, syscall.EISDIR
+	}
+	minShards, err := fs.minShardsFor(name)
+	if err != nil {
+		return nil, err
+	}
+	e := &journalEntry{
+		Name:      name,
+		Mode:      stat.Mode(),
+		MinShards: minShards,
+	}
+	// keep the metafile's owner
+	if mstat, err := os.Stat(fs.metaPath(name, false)); err == nil {
+		if sys, ok := mstat.Sys().(*syscall.Stat_t); ok {
+			e.UID, e.GID = &sys.Uid, &sys.Gid
+		}
+	}
+	var r io.Reader
+	if !truncate {
+		pf, err := fs.pfs.OpenFile(name, os.O_RDONLY, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer pf.Close()
+		r = pf
+	}
+	return fs.journal.Stage(e, r, flags)
 }
 
 // Create implements pathfs.FileSystem.
 func (fs *fuseFS) Create(name string, flags uint32, mode uint32, _ *fuse.Context) (file nodefs.File, code fuse.Status) {
-	pf, err := fs.pfs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.FileMode(mode), fs.minShards)
+	minShards, err := fs.minShardsFor(name)
+	if err != nil {
+		return nil, errToStatus("Create", name, err)
+	}
+	if fs.journal != nil {
+		f, err := fs.journal.Create(name, os.FileMode(mode), minShards)
+		if err != nil {
+			return nil, errToStatus("Create", name, err)
+		}
+		return f, fuse.OK
+	}
+	pf, err := fs.pfs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.FileMode(mode), minShards)
 	if err != nil {
 		return nil, errToStatus("Create", name, err)
 	}
 	return &metaFSFile{
 		File: nodefs.NewDefaultFile(),
+		fs:   fs,
+		h:    fs.openHandle(name),
 		pf:   pf,
 	}, fuse.OK
 }
 
 // Unlink implements pathfs.FileSystem.
 func (fs *fuseFS) Unlink(name string, _ *fuse.Context) (code fuse.Status) {
+	if _, ok := fs.symlinkStat(name); ok {
+		return errToStatus("Unlink", name, os.Remove(fs.symlinkPath(name)))
+	}
+	if fs.journal != nil && fs.journal.Remove(name) {
+		// the file may or may not have a previous version on hosts
+		if err := fs.pfs.Remove(name); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return errToStatus("Unlink", name, err)
+		}
+		return fuse.OK
+	}
 	if err := fs.pfs.Remove(name); err != nil {
 		return errToStatus("Unlink", name, err)
 	}
@@ -135,9 +667,44 @@ func (fs *fuseFS) Unlink(name string, _ *fuse.Context) (code fuse.Status) {
 
 // Rename implements pathfs.FileSystem.
 func (fs *fuseFS) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
-	if err := fs.pfs.Rename(oldName, newName); err != nil {
+	if _, ok := fs.symlinkStat(oldName); ok {
+		// replace whatever is at newName
+		if fs.journal != nil {
+			fs.journal.Remove(newName)
+		}
+		if err := fs.pfs.Remove(newName); err != nil && !os.IsNotExist(errors.Cause(err)) {
+			return errToStatus("Rename", oldName, err)
+		}
+		return errToStatus("Rename", oldName, os.Rename(fs.symlinkPath(oldName), fs.symlinkPath(newName)))
+	}
+	// likewise, a file replaces any symlink at newName
+	if err := os.Remove(fs.symlinkPath(newName)); err != nil && !os.IsNotExist(err) {
 		return errToStatus("Rename", oldName, err)
 	}
+	if fs.journal != nil {
+		if ok, err := fs.journal.Rename(oldName, newName); err != nil {
+			return errToStatus("Rename", oldName, err)
+		} else if ok {
+			// remove any previous version on hosts
+			if err := fs.pfs.Remove(oldName); err != nil && !os.IsNotExist(errors.Cause(err)) {
+				return errToStatus("Rename", oldName, err)
+			}
+			return fuse.OK
+		}
+	}
+	rename := func() error { return fs.pfs.Rename(oldName, newName) }
+	var err error
+	if fs.journal != nil {
+		// staged files within a renamed directory move with it, and a staged
+		// file at newName is replaced
+		err = fs.journal.RenameUploaded(oldName, newName, rename)
+	} else {
+		err = rename()
+	}
+	if err != nil {
+		return errToStatus("Rename", oldName, err)
+	}
+	fs.renameHandles(oldName, newName)
 	return fuse.OK
 }
 
@@ -151,7 +718,15 @@ func (fs *fuseFS) Mkdir(name string, mode uint32, context *fuse.Context) (code f
 
 // Rmdir implements pathfs.FileSystem.
 func (fs *fuseFS) Rmdir(name string, _ *fuse.Context) (code fuse.Status) {
-	if err := fs.pfs.RemoveAll(name); err != nil {
+	remove := func() error { return fs.pfs.RemoveAll(name) }
+	var err error
+	if fs.journal != nil {
+		// discard any staged files within the directory, too
+		err = fs.journal.RemoveDir(name, remove)
+	} else {
+		err = remove()
+	}
+	if err != nil {
 		return errToStatus("Rmdir", name, err)
 	}
 	return fuse.OK
@@ -159,30 +734,487 @@ func (fs *fuseFS) Rmdir(name string, _ *fuse.Context) (code fuse.Status) {
 
 // Chmod implements pathfs.FileSystem.
 func (fs *fuseFS) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	if fs.journal != nil {
+		if ok, err := fs.journal.Update(name, func(e *journalEntry) {
+			e.Mode = os.FileMode(mode)
+		}); ok || err != nil {
+			return errToStatus("Chmod", name, err)
+		}
+	}
 	if err := fs.pfs.Chmod(name, os.FileMode(mode)); err != nil {
 		return errToStatus("Chmod", name, err)
 	}
 	return fuse.OK
 }
 
-func fileSystem(pfs *renterutil.PseudoFS, minShards int) *fuseFS {
+// extended attributes exposing Sia metadata
+const (
+	xattrMinShards   = "user.sia.min_shards"
+	xattrHosts       = "user.sia.hosts"
+	xattrRedundancy  = "user.sia.redundancy"
+	xattrUploadedPct = "user.sia.uploaded_pct"
+	xattrHealth      = "user.sia.health"
+)
+
+// GetXAttr implements pathfs.FileSystem.
+func (fs *fuseFS) GetXAttr(name string, attr string, _ *fuse.Context) ([]byte, fuse.Status) {
+	if fs.isDir(name) {
+		// directories only have a min_shards setting, which applies to new
+		// files created within them
+		if attr != xattrMinShards {
+			return nil, fuse.ENOATTR
+		}
+		minShards, err := dirMinShards(fs.root, name, fs.minShards, fs.hosts)
+		if err != nil {
+			return nil, errToStatus("GetXAttr", name, err)
+		}
+		return []byte(strconv.Itoa(minShards)), fuse.OK
+	}
+	m, code := fs.readMetaFile("GetXAttr", name)
+	if code != fuse.OK {
+		return nil, code
+	}
+	var val string
+	switch attr {
+	case xattrMinShards:
+		val = strconv.Itoa(m.MinShards)
+	case xattrHosts:
+		hosts := make([]string, len(m.Hosts))
+		for i, h := range m.Hosts {
+			hosts[i] = string(h)
+		}
+		val = strings.Join(hosts, "\n")
+	case xattrRedundancy:
+		val = strconv.FormatFloat(float64(len(m.Hosts))/float64(m.MinShards), 'f', 2, 64)
+	case xattrUploadedPct:
+		_, pct := uploadProgress(m)
+		val = strconv.FormatFloat(pct, 'f', 2, 64)
+	case xattrHealth:
+		val = fileHealth(m)
+	default:
+		return nil, fuse.ENOATTR
+	}
+	return []byte(val), fuse.OK
+}
+
+// ListXAttr implements pathfs.FileSystem.
+func (fs *fuseFS) ListXAttr(name string, _ *fuse.Context) ([]string, fuse.Status) {
+	if fs.isDir(name) {
+		return []string{xattrMinShards}, fuse.OK
+	}
+	if _, code := fs.readMetaFile("ListXAttr", name); code == fuse.ENOATTR {
+		return nil, fuse.OK
+	} else if code != fuse.OK {
+		return nil, code
+	}
+	return []string{xattrMinShards, xattrHosts, xattrRedundancy, xattrUploadedPct, xattrHealth}, fuse.OK
+}
+
+// SetXAttr implements pathfs.FileSystem. Only the min_shards attribute of
+// directories can be set; existing files cannot be re-encoded in place.
+func (fs *fuseFS) SetXAttr(name string, attr string, data []byte, flags int, _ *fuse.Context) fuse.Status {
+	if attr != xattrMinShards || !fs.isDir(name) {
+		return fuse.Status(syscall.ENOTSUP)
+	}
+	minShards, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || minShards < 1 || (fs.hosts > 0 && minShards > fs.hosts) {
+		// files can't have more shards than there are hosts
+		return fuse.EINVAL
+	}
+	if err := setDirMinShards(fs.metaPath(name, true), minShards); err != nil {
+		return errToStatus("SetXAttr", name, err)
+	}
+	return fuse.OK
+}
+
+// RemoveXAttr implements pathfs.FileSystem. Removing the min_shards attribute
+// of a directory causes it to inherit the setting of its parent.
+func (fs *fuseFS) RemoveXAttr(name string, attr string, _ *fuse.Context) fuse.Status {
+	if attr != xattrMinShards || !fs.isDir(name) {
+		return fuse.Status(syscall.ENOTSUP)
+	}
+	if err := setDirMinShards(fs.metaPath(name, true), 0); err != nil {
+		return errToStatus("RemoveXAttr", name, err)
+	}
+	return fuse.OK
+}
+
+// readMetaFile reads the metafile underlying name. Directories have no
+// metafile, and thus no attributes.
+func (fs *fuseFS) readMetaFile(op, name string) (*renter.MetaFile, fuse.Status) {
+	if _, _, ok := fs.staged(name); ok {
+		return nil, fuse.ENOATTR // not uploaded yet
+	}
+	stat, err := fs.pfs.Stat(name)
+	if err != nil {
+		return nil, errToStatus(op, name, err)
+	} else if stat.IsDir() {
+		return nil, fuse.ENOATTR
+	}
+	m, err := renter.ReadMetaFile(fs.metaPath(name, false))
+	if err != nil {
+		return nil, errToStatus(op, name, err)
+	}
+	return m, fuse.OK
+}
+
+// StatFs implements pathfs.FileSystem.
+func (fs *fuseFS) StatFs(name string) *fuse.StatfsOut {
+	const blockSize = 4096
+	fs.statMu.Lock()
+	defer fs.statMu.Unlock()
+	// walking the metafolder is expensive, so don't do it too often
+	if time.Since(fs.lastStat) > statFsInterval {
+		used, err := storedBytes(fs.root)
+		if err != nil {
+			log.Printf("StatFs %v: %v", name, err)
+		} else {
+			fs.used, fs.lastStat = used, time.Now()
+		}
+	}
+	var free uint64
+	if fs.capacity != nil {
+		free = fs.capacity.free()
+	}
+	total := fs.used + free
+	return &fuse.StatfsOut{
+		Blocks:  total / blockSize,
+		Bfree:   free / blockSize,
+		Bavail:  free / blockSize,
+		Bsize:   blockSize,
+		Frsize:  blockSize,
+		NameLen: 255,
+	}
+}
+
+const statFsInterval = 30 * time.Second
+
+// storedBytes returns the number of file bytes stored by the metafiles in
+// metaDir. Each file counts for the data it has uploaded divided by its
+// redundancy, so partially-uploaded files are reported proportionally.
+func storedBytes(metaDir string) (uint64, error) {
+	var total uint64
+	err := filepath.Walk(metaDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() || info.Mode()&os.ModeSymlink != 0 || !strings.HasSuffix(path, metafileExt) {
+			return nil
+		}
+		m, err := renter.ReadMetaFile(path)
+		if err != nil {
+			return err
+		}
+		if uploaded, _ := uploadProgress(m); len(m.Hosts) > 0 {
+			total += uint64(uploaded) * uint64(m.MinShards) / uint64(len(m.Hosts))
+		}
+		return nil
+	})
+	return total, err
+}
+
+// A capacityEstimate tracks the number of additional bytes that can be stored
+// on a set of hosts, based on each contract's remaining funds and its host's
+// storage price. The estimate does not account for bandwidth costs, so it is an
+// upper bound.
+//
+// While the mount's HostSet is connected to a host, it holds the lock on the
+// host's contract, so the host can't be queried separately. Instead, the
+// estimate is taken from the HostSet's own sessions: each is measured when it
+// connects, and its funds are updated as its RPCs spend them. Hosts are only
+// queried directly once, in the background, when the mount starts, and hosts
+// that the HostSet has already connected to are skipped.
+type capacityEstimate struct {
+	contracts     []renter.Contract
+	hkr           renter.HostKeyResolver
+	minShards     int
+	currentHeight types.BlockHeight
+
+	mu        sync.Mutex
+	hosts     map[hostdb.HostPublicKey]hostCapacity
+	connected map[hostdb.HostPublicKey]bool // hosts measured by the HostSet
+}
+
+// A hostCapacity is the information needed to estimate how much can be
+// stored on a host.
+type hostCapacity struct {
+	remaining uint64         // storage remaining on the host
+	funds     types.Currency // remaining renter funds in the contract
+	price     types.Currency // cost of storing one byte until the contract expires
+}
+
+// free returns the number of bytes that can be stored on the host.
+func (hc hostCapacity) free() uint64 {
+	free := hc.remaining
+	if !hc.price.IsZero() {
+		if n, err := hc.funds.Div(hc.price).Uint64(); err == nil && n < free {
+			free = n
+		}
+	}
+	return free
+}
+
+func newHostCapacity(rev proto.ContractRevision, settings hostdb.HostSettings, currentHeight types.BlockHeight) hostCapacity {
+	if rev.EndHeight() <= currentHeight {
+		return hostCapacity{}
+	}
+	return hostCapacity{
+		remaining: settings.RemainingStorage,
+		funds:     rev.RenterFunds(),
+		price:     settings.StoragePrice.Mul64(uint64(rev.EndHeight() - currentHeight)),
+	}
+}
+
+// free returns the current estimate, after redundancy.
+func (ce *capacityEstimate) free() uint64 {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	if len(ce.contracts) == 0 {
+		return 0
+	}
+	var total uint64
+	for _, hc := range ce.hosts {
+		total += hc.free()
+	}
+	return total * uint64(ce.minShards) / uint64(len(ce.contracts))
+}
+
+// onConnect measures a session newly connected by the HostSet, and arranges
+// for its spending to be tracked. It is called while the HostSet holds the
+// session, so the session can be used safely.
+func (ce *capacityEstimate) onConnect(s *proto.Session) {
+	ce.mu.Lock()
+	ce.connected[s.HostKey()] = true
+	ce.mu.Unlock()
+	s.SetRPCStatsRecorder(ce)
+	settings, err := s.Settings()
+	if err != nil {
+		return // keep the last known capacity
+	}
+	hc := newHostCapacity(s.Revision(), settings, ce.currentHeight)
+	ce.mu.Lock()
+	ce.hosts[s.HostKey()] = hc
+	ce.mu.Unlock()
+}
+
+// RecordRPCStats implements proto.RPCStatsRecorder, deducting the cost of
+// each RPC from the funds of its host's contract.
+func (ce *capacityEstimate) RecordRPCStats(stats proto.RPCStats) {
+	if stats.Cost.IsZero() {
+		return
+	}
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	if hc, ok := ce.hosts[stats.Host]; ok {
+		if hc.funds.Cmp(stats.Cost) > 0 {
+			hc.funds = hc.funds.Sub(stats.Cost)
+		} else {
+			hc.funds = types.ZeroCurrency
+		}
+		ce.hosts[stats.Host] = hc
+	}
+}
+
+// query measures each host that the HostSet has not yet connected to, in the
+// background.
+func (ce *capacityEstimate) query() {
+	for _, c := range ce.contracts {
+		go func(c renter.Contract) {
+			ce.mu.Lock()
+			connected := ce.connected[c.HostKey]
+			ce.mu.Unlock()
+			if connected {
+				return
+			}
+			hc, err := queryHostCapacity(c, ce.hkr, ce.currentHeight)
+			if err != nil {
+				log.Printf("Could not query host %v: %v", c.HostKey.ShortKey(), err)
+				return
+			}
+			ce.mu.Lock()
+			defer ce.mu.Unlock()
+			if !ce.connected[c.HostKey] {
+				ce.hosts[c.HostKey] = hc
+			}
+		}(c)
+	}
+}
+
+func newCapacityEstimate(contracts []renter.Contract, hkr renter.HostKeyResolver, minShards int, currentHeight types.BlockHeight) *capacityEstimate {
+	return &capacityEstimate{
+		contracts:     contracts,
+		hkr:           hkr,
+		minShards:     minShards,
+		currentHeight: currentHeight,
+		hosts:         make(map[hostdb.HostPublicKey]hostCapacity),
+		connected:     make(map[hostdb.HostPublicKey]bool),
+	}
+}
+
+func queryHostCapacity(c renter.Contract, hkr renter.HostKeyResolver, currentHeight types.BlockHeight) (hostCapacity, error) {
+	hostIP, err := hkr.ResolveHostKey(c.HostKey)
+	if err != nil {
+		return hostCapacity{}, err
+	}
+	s, err := proto.NewSession(hostIP, c.HostKey, c.ID, c.RenterKey, currentHeight)
+	if err != nil {
+		return hostCapacity{}, err
+	}
+	defer s.Close()
+	settings, err := s.Settings()
+	if err != nil {
+		return hostCapacity{}, err
+	}
+	return newHostCapacity(s.Revision(), settings, currentHeight), nil
+}
+
+// Chown implements pathfs.FileSystem.
+func (fs *fuseFS) Chown(name string, uid uint32, gid uint32, _ *fuse.Context) (code fuse.Status) {
+	// -1 means "leave unchanged"
+	id := func(i uint32) int {
+		if i == ^uint32(0) {
+			return -1
+		}
+		return int(i)
+	}
+	if _, ok := fs.symlinkStat(name); ok {
+		return errToStatus("Chown", name, os.Lchown(fs.symlinkPath(name), id(uid), id(gid)))
+	}
+	if fs.journal != nil {
+		// the metafile doesn't exist yet, so set its owner once it's uploaded
+		if ok, err := fs.journal.Update(name, func(e *journalEntry) {
+			e.setOwner(uid, gid)
+		}); ok || err != nil {
+			return errToStatus("Chown", name, err)
+		}
+	}
+	stat, err := fs.pfs.Stat(name)
+	if err != nil {
+		return errToStatus("Chown", name, err)
+	}
+	if err := os.Lchown(fs.metaPath(name, stat.IsDir()), id(uid), id(gid)); err != nil {
+		return errToStatus("Chown", name, err)
+	}
+	return fuse.OK
+}
+
+// Utimens implements pathfs.FileSystem.
+func (fs *fuseFS) Utimens(name string, atime *time.Time, mtime *time.Time, _ *fuse.Context) (code fuse.Status) {
+	if mtime == nil {
+		return fuse.OK // access times are not tracked
+	}
+	if atime == nil {
+		atime = mtime
+	}
+	if _, ok := fs.symlinkStat(name); ok {
+		return errToStatus("Utimens", name, os.Chtimes(fs.symlinkPath(name), *atime, *mtime))
+	}
+	if fs.journal != nil {
+		if ok, err := fs.journal.Update(name, func(e *journalEntry) {
+			e.ModTime = *mtime
+		}); ok || err != nil {
+			return errToStatus("Utimens", name, err)
+		}
+	}
+	stat, err := fs.pfs.Stat(name)
+	if err != nil {
+		return errToStatus("Utimens", name, err)
+	}
+	if stat.IsDir() {
+		return errToStatus("Utimens", name, os.Chtimes(fs.metaPath(name, true), *atime, *mtime))
+	}
+	// closing the file would overwrite the new time, so defer it until the
+	// last handle is released
+	fs.handleMu.Lock()
+	if h, ok := fs.handles[name]; ok {
+		t := *mtime
+		h.mtime = &t
+		fs.handleMu.Unlock()
+		return fuse.OK
+	}
+	fs.handleMu.Unlock()
+	return errToStatus("Utimens", name, setModTime(fs.pfs, fs.root, name, *mtime))
+}
+
+// setModTime sets the modification time of the uploaded file name. PseudoFS
+// has no equivalent of os.Chtimes, so the metafile is rewritten directly.
+// First, though, any data that PseudoFS has buffered for the file is flushed;
+// otherwise, the eventual flush would overwrite the metafile.
+func setModTime(pfs *renterutil.PseudoFS, root, name string, mtime time.Time) error {
+	pf, err := pfs.OpenFile(name, os.O_RDWR, 0, 0)
+	if err != nil {
+		return err
+	}
+	if err := pf.Sync(); err != nil {
+		pf.Close()
+		return err
+	} else if err := pf.Close(); err != nil {
+		return err
+	}
+	metaPath := filepath.Join(root, name+metafileExt)
+	m, err := renter.ReadMetaFile(metaPath)
+	if err != nil {
+		return err
+	}
+	m.ModTime = mtime
+	return renter.WriteMetaFile(metaPath, m)
+}
+
+// Truncate implements pathfs.FileSystem.
+func (fs *fuseFS) Truncate(name string, size uint64, _ *fuse.Context) (code fuse.Status) {
+	if fs.journal != nil {
+		if ok, err := fs.journal.Truncate(name, int64(size)); ok || err != nil {
+			return errToStatus("Truncate", name, err)
+		}
+		// stage the file, rather than modifying it in place
+		f, err := fs.stage(name, os.O_WRONLY, size == 0)
+		if err != nil {
+			return errToStatus("Truncate", name, err)
+		}
+		defer f.Release()
+		return f.Truncate(size)
+	}
+	pf, err := fs.pfs.OpenFile(name, os.O_RDWR, 0, 0)
+	if err != nil {
+		return errToStatus("Truncate", name, err)
+	}
+	if err := pf.Truncate(int64(size)); err != nil {
+		pf.Close()
+		return errToStatus("Truncate", name, err)
+	}
+	return errToStatus("Truncate", name, pf.Close())
+}
+
+func fileSystem(pfs *renterutil.PseudoFS, metaDir string, minShards int) *fuseFS {
 	return &fuseFS{
 		FileSystem: pathfs.NewDefaultFileSystem(),
 		pfs:        pfs,
+		root:       metaDir,
 		minShards:  minShards,
+		handles:    make(map[string]*openHandle),
 	}
 }
 
 type metaFSFile struct {
 	nodefs.File
+	fs *fuseFS
+	h  *openHandle
 	pf *renterutil.PseudoFile
+	r  io.ReaderAt // cached and/or prefetching reader; may be nil
 
 	mu      sync.Mutex
 	br      *bufio.Reader
 	lastOff int64
+	written bool
 }
 
 func (f *metaFSFile) Read(p []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	if f.r != nil {
+		n, err := f.r.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			return nil, errToStatus("Read", f.pf.Name(), err)
+		}
+		return fuse.ReadResultData(p[:n]), fuse.OK
+	}
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	if f.br == nil || off != f.lastOff {
@@ -190,7 +1222,7 @@ func (f *metaFSFile) Read(p []byte, off int64) (fuse.ReadResult, fuse.Status) {
 		if err != nil {
 			return nil, errToStatus("Read", f.pf.Name(), err)
 		}
-		sr := io.NewSectionReader(f.pf, off, stat.Size()-off)
+		sr := io.NewSectionReader(timedReaderAt{f.pf}, off, stat.Size()-off)
 		if f.br == nil {
 			f.br = bufio.NewReaderSize(sr, 1<<20) // 1 MB
 		} else {
@@ -210,17 +1242,162 @@ func (f *metaFSFile) Write(p []byte, off int64) (written uint32, code fuse.Statu
 	if err != nil {
 		return 0, errToStatus("Write", f.pf.Name(), err)
 	}
+	f.markWritten()
 	return uint32(n), fuse.OK
 }
 
 func (f *metaFSFile) Truncate(size uint64) fuse.Status {
+	f.markWritten()
 	return errToStatus("Truncate", f.pf.Name(), f.pf.Truncate(int64(size)))
 }
 
+func (f *metaFSFile) markWritten() {
+	f.mu.Lock()
+	f.written = true
+	f.mu.Unlock()
+}
+
+// Flush uploads any data written to the file before closing it. Otherwise,
+// the data would remain buffered in the PseudoFS until unmount, where it
+// could only be uploaded by closing the PseudoFS -- and with it, the HostSet
+// shared by every member of an overlay.
 func (f *metaFSFile) Flush() fuse.Status {
+	f.mu.Lock()
+	written := f.written
+	f.written = false
+	f.mu.Unlock()
+	if written {
+		if err := f.pf.Sync(); err != nil {
+			return errToStatus("Flush", f.pf.Name(), err)
+		}
+	}
 	return errToStatus("Flush", f.pf.Name(), f.pf.Close())
 }
 
 func (f *metaFSFile) Fsync(flags int) fuse.Status {
 	return errToStatus("Fsync", f.pf.Name(), f.pf.Sync())
 }
+
+func (f *metaFSFile) Release() {
+	if c, ok := f.r.(io.Closer); ok {
+		c.Close() // cancel any prefetches
+	}
+	f.fs.releaseHandle(f.h)
+}
+
+// The remaining attribute methods are called for operations on open files,
+// e.g. futimens(2); they behave like their pathfs.FileSystem counterparts.
+
+func (f *metaFSFile) GetAttr(out *fuse.Attr) fuse.Status {
+	attr, code := f.fs.GetAttr(f.fs.handleName(f.h), nil)
+	if code == fuse.OK {
+		*out = *attr
+	}
+	return code
+}
+
+func (f *metaFSFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	return f.fs.Utimens(f.fs.handleName(f.h), atime, mtime, nil)
+}
+
+func (f *metaFSFile) Chown(uid uint32, gid uint32) fuse.Status {
+	return f.fs.Chown(f.fs.handleName(f.h), uid, gid, nil)
+}
+
+func (f *metaFSFile) Chmod(perms uint32) fuse.Status {
+	return f.fs.Chmod(f.fs.handleName(f.h), perms, nil)
+}
+
+// An unstagedFile is an uploaded file opened for writing while the journal is
+// enabled. Writing to it in place would bypass the journal, so it is staged
+// when first modified: truncating it to zero stages an empty file, and any
+// other modification stages a copy of its contents. Until then, it is read
+// from hosts.
+type unstagedFile struct {
+	*metaFSFile // opened read-only
+	flags       int
+
+	stageMu sync.Mutex
+	staged  nodefs.File
+}
+
+// stagedFile returns the staged file, or nil if the file has not been staged.
+func (f *unstagedFile) stagedFile() nodefs.File {
+	f.stageMu.Lock()
+	defer f.stageMu.Unlock()
+	return f.staged
+}
+
+// stage stages the file, if it hasn't been already.
+func (f *unstagedFile) stage(truncate bool) (nodefs.File, fuse.Status) {
+	f.stageMu.Lock()
+	defer f.stageMu.Unlock()
+	if f.staged == nil {
+		name := f.fs.handleName(f.h)
+		sf, err := f.fs.stage(name, f.flags, truncate)
+		if err != nil {
+			return nil, errToStatus("Stage", name, err)
+		}
+		f.staged = sf
+		// reads are now served by the staged file
+		if c, ok := f.r.(io.Closer); ok {
+			c.Close()
+		}
+		f.pf.Close()
+	}
+	return f.staged, fuse.OK
+}
+
+func (f *unstagedFile) Read(p []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	if sf := f.stagedFile(); sf != nil {
+		return sf.Read(p, off)
+	}
+	return f.metaFSFile.Read(p, off)
+}
+
+func (f *unstagedFile) Write(p []byte, off int64) (uint32, fuse.Status) {
+	sf, code := f.stage(false)
+	if code != fuse.OK {
+		return 0, code
+	}
+	return sf.Write(p, off)
+}
+
+func (f *unstagedFile) Truncate(size uint64) fuse.Status {
+	sf, code := f.stage(size == 0)
+	if code != fuse.OK {
+		return code
+	}
+	return sf.Truncate(size)
+}
+
+func (f *unstagedFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	sf, code := f.stage(false)
+	if code != fuse.OK {
+		return code
+	}
+	return sf.Allocate(off, size, mode)
+}
+
+func (f *unstagedFile) Flush() fuse.Status {
+	if sf := f.stagedFile(); sf != nil {
+		return sf.Flush()
+	}
+	return f.metaFSFile.Flush()
+}
+
+func (f *unstagedFile) Fsync(flags int) fuse.Status {
+	if sf := f.stagedFile(); sf != nil {
+		return sf.Fsync(flags)
+	}
+	return fuse.OK // nothing has been written
+}
+
+func (f *unstagedFile) Release() {
+	if sf := f.stagedFile(); sf != nil {
+		sf.Release()
+		f.fs.releaseHandle(f.h)
+		return
+	}
+	f.metaFSFile.Release()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+
+	"go.sia.tech/siad/types"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
+)
+
+func TestCapacityEstimate(t *testing.T) {
+	var hk1, hk2 hostdb.HostPublicKey = "ed25519:01", "ed25519:02"
+	contracts := []renter.Contract{{HostKey: hk1}, {HostKey: hk2}}
+	ce := newCapacityEstimate(contracts, nil, 1, 100)
+	if free := ce.free(); free != 0 {
+		t.Fatalf("expected no free space before any host is measured, got %v", free)
+	}
+
+	// one host limited by storage, the other by funds
+	ce.hosts[hk1] = hostCapacity{remaining: 1000, funds: types.NewCurrency64(1e6), price: types.NewCurrency64(1)}
+	ce.hosts[hk2] = hostCapacity{remaining: 1e9, funds: types.NewCurrency64(3000), price: types.NewCurrency64(1)}
+	if free := ce.free(); free != (1000+3000)/2 {
+		t.Fatalf("expected %v free, got %v", (1000+3000)/2, free)
+	}
+
+	// spending reduces the estimate, but never below zero
+	ce.RecordRPCStats(proto.RPCStats{Host: hk2, Cost: types.NewCurrency64(1000)})
+	if free := ce.free(); free != (1000+2000)/2 {
+		t.Fatalf("expected %v free, got %v", (1000+2000)/2, free)
+	}
+	ce.RecordRPCStats(proto.RPCStats{Host: hk2, Cost: types.NewCurrency64(1e9)})
+	if free := ce.free(); free != 1000/2 {
+		t.Fatalf("expected %v free, got %v", 1000/2, free)
+	}
+	// unknown hosts are ignored
+	ce.RecordRPCStats(proto.RPCStats{Host: "ed25519:03", Cost: types.NewCurrency64(1)})
+	if len(ce.hosts) != 2 {
+		t.Fatal("unknown host was added")
+	}
+}
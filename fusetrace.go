@@ -0,0 +1,204 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+)
+
+var (
+	fuseOps        = newCounterVec("user_fuse_ops_total", "Number of FUSE operations.", "op")
+	fuseErrors     = newCounterVec("user_fuse_errors_total", "Number of FUSE operations that returned an error.", "op", "status")
+	fuseOpDuration = newHistogramVec("user_fuse_op_duration_seconds", "Latency of FUSE operations.", latencyBuckets, "op")
+	fuseReadBytes  = newCounterVec("user_fuse_read_bytes_total", "Bytes read through the FUSE filesystem.")
+	fuseWriteBytes = newCounterVec("user_fuse_write_bytes_total", "Bytes written through the FUSE filesystem.")
+)
+
+// A tracedFS wraps a pathfs.FileSystem, recording metrics for each operation
+// and optionally logging it.
+type tracedFS struct {
+	pathfs.FileSystem
+	trace bool
+}
+
+// observe records an operation that started at start and returned code.
+func (fs *tracedFS) observe(op, name string, start time.Time, code fuse.Status) {
+	d := time.Since(start)
+	fuseOps.inc(op)
+	fuseOpDuration.observe(d.Seconds(), op)
+	// ENOENT and ENOATTR are routine responses to lookups, not failures
+	if code != fuse.OK && code != fuse.ENOENT && code != fuse.ENOATTR {
+		fuseErrors.inc(op, code.String())
+	}
+	if fs.trace {
+		log.Printf("%v %q: %v (%v)", op, name, code, d)
+	}
+}
+
+// GetAttr implements pathfs.FileSystem.
+func (fs *tracedFS) GetAttr(name string, context *fuse.Context) (attr *fuse.Attr, code fuse.Status) {
+	defer func(start time.Time) { fs.observe("GetAttr", name, start, code) }(time.Now())
+	return fs.FileSystem.GetAttr(name, context)
+}
+
+// OpenDir implements pathfs.FileSystem.
+func (fs *tracedFS) OpenDir(name string, context *fuse.Context) (entries []fuse.DirEntry, code fuse.Status) {
+	defer func(start time.Time) { fs.observe("OpenDir", name, start, code) }(time.Now())
+	return fs.FileSystem.OpenDir(name, context)
+}
+
+// Open implements pathfs.FileSystem.
+func (fs *tracedFS) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	defer func(start time.Time) { fs.observe("Open", name, start, code) }(time.Now())
+	file, code = fs.FileSystem.Open(name, flags, context)
+	if code == fuse.OK {
+		file = &tracedFile{File: file, fs: fs, name: name}
+	}
+	return file, code
+}
+
+// Create implements pathfs.FileSystem.
+func (fs *tracedFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
+	defer func(start time.Time) { fs.observe("Create", name, start, code) }(time.Now())
+	file, code = fs.FileSystem.Create(name, flags, mode, context)
+	if code == fuse.OK {
+		file = &tracedFile{File: file, fs: fs, name: name}
+	}
+	return file, code
+}
+
+// Unlink implements pathfs.FileSystem.
+func (fs *tracedFS) Unlink(name string, context *fuse.Context) (code fuse.Status) {
+	defer func(start time.Time) { fs.observe("Unlink", name, start, code) }(time.Now())
+	return fs.FileSystem.Unlink(name, context)
+}
+
+// Rename implements pathfs.FileSystem.
+func (fs *tracedFS) Rename(oldName string, newName string, context *fuse.Context) (code fuse.Status) {
+	defer func(start time.Time) { fs.observe("Rename", oldName+" -> "+newName, start, code) }(time.Now())
+	return fs.FileSystem.Rename(oldName, newName, context)
+}
+
+// Mkdir implements pathfs.FileSystem.
+func (fs *tracedFS) Mkdir(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	defer func(start time.Time) { fs.observe("Mkdir", name, start, code) }(time.Now())
+	return fs.FileSystem.Mkdir(name, mode, context)
+}
+
+// Rmdir implements pathfs.FileSystem.
+func (fs *tracedFS) Rmdir(name string, context *fuse.Context) (code fuse.Status) {
+	defer func(start time.Time) { fs.observe("Rmdir", name, start, code) }(time.Now())
+	return fs.FileSystem.Rmdir(name, context)
+}
+
+// Chmod implements pathfs.FileSystem.
+func (fs *tracedFS) Chmod(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
+	defer func(start time.Time) { fs.observe("Chmod", name, start, code) }(time.Now())
+	return fs.FileSystem.Chmod(name, mode, context)
+}
+
+// Chown implements pathfs.FileSystem.
+func (fs *tracedFS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) (code fuse.Status) {
+	defer func(start time.Time) { fs.observe("Chown", name, start, code) }(time.Now())
+	return fs.FileSystem.Chown(name, uid, gid, context)
+}
+
+// Utimens implements pathfs.FileSystem.
+func (fs *tracedFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) (code fuse.Status) {
+	defer func(start time.Time) { fs.observe("Utimens", name, start, code) }(time.Now())
+	return fs.FileSystem.Utimens(name, atime, mtime, context)
+}
+
+// Truncate implements pathfs.FileSystem.
+func (fs *tracedFS) Truncate(name string, size uint64, context *fuse.Context) (code fuse.Status) {
+	defer func(start time.Time) { fs.observe("Truncate", name, start, code) }(time.Now())
+	return fs.FileSystem.Truncate(name, size, context)
+}
+
+// Symlink implements pathfs.FileSystem.
+func (fs *tracedFS) Symlink(value string, linkName string, context *fuse.Context) (code fuse.Status) {
+	defer func(start time.Time) { fs.observe("Symlink", linkName, start, code) }(time.Now())
+	return fs.FileSystem.Symlink(value, linkName, context)
+}
+
+// Readlink implements pathfs.FileSystem.
+func (fs *tracedFS) Readlink(name string, context *fuse.Context) (target string, code fuse.Status) {
+	defer func(start time.Time) { fs.observe("Readlink", name, start, code) }(time.Now())
+	return fs.FileSystem.Readlink(name, context)
+}
+
+// GetXAttr implements pathfs.FileSystem.
+func (fs *tracedFS) GetXAttr(name string, attr string, context *fuse.Context) (data []byte, code fuse.Status) {
+	defer func(start time.Time) { fs.observe("GetXAttr", name, start, code) }(time.Now())
+	return fs.FileSystem.GetXAttr(name, attr, context)
+}
+
+// ListXAttr implements pathfs.FileSystem.
+func (fs *tracedFS) ListXAttr(name string, context *fuse.Context) (attrs []string, code fuse.Status) {
+	defer func(start time.Time) { fs.observe("ListXAttr", name, start, code) }(time.Now())
+	return fs.FileSystem.ListXAttr(name, context)
+}
+
+// SetXAttr implements pathfs.FileSystem.
+func (fs *tracedFS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) (code fuse.Status) {
+	defer func(start time.Time) { fs.observe("SetXAttr", name, start, code) }(time.Now())
+	return fs.FileSystem.SetXAttr(name, attr, data, flags, context)
+}
+
+// RemoveXAttr implements pathfs.FileSystem.
+func (fs *tracedFS) RemoveXAttr(name string, attr string, context *fuse.Context) (code fuse.Status) {
+	defer func(start time.Time) { fs.observe("RemoveXAttr", name, start, code) }(time.Now())
+	return fs.FileSystem.RemoveXAttr(name, attr, context)
+}
+
+// StatFs implements pathfs.FileSystem.
+func (fs *tracedFS) StatFs(name string) *fuse.StatfsOut {
+	defer func(start time.Time) { fs.observe("StatFs", name, start, fuse.OK) }(time.Now())
+	return fs.FileSystem.StatFs(name)
+}
+
+// A tracedFile wraps a nodefs.File, recording metrics for each operation.
+type tracedFile struct {
+	nodefs.File
+	fs   *tracedFS
+	name string
+}
+
+func (f *tracedFile) Read(p []byte, off int64) (res fuse.ReadResult, code fuse.Status) {
+	defer func(start time.Time) { f.fs.observe("Read", f.name, start, code) }(time.Now())
+	res, code = f.File.Read(p, off)
+	if code == fuse.OK {
+		fuseReadBytes.add(float64(res.Size()))
+	}
+	return res, code
+}
+
+func (f *tracedFile) Write(p []byte, off int64) (written uint32, code fuse.Status) {
+	defer func(start time.Time) { f.fs.observe("Write", f.name, start, code) }(time.Now())
+	written, code = f.File.Write(p, off)
+	fuseWriteBytes.add(float64(written))
+	return written, code
+}
+
+func (f *tracedFile) Truncate(size uint64) (code fuse.Status) {
+	defer func(start time.Time) { f.fs.observe("Ftruncate", f.name, start, code) }(time.Now())
+	return f.File.Truncate(size)
+}
+
+func (f *tracedFile) Flush() (code fuse.Status) {
+	defer func(start time.Time) { f.fs.observe("Flush", f.name, start, code) }(time.Now())
+	return f.File.Flush()
+}
+
+func (f *tracedFile) Fsync(flags int) (code fuse.Status) {
+	defer func(start time.Time) { f.fs.observe("Fsync", f.name, start, code) }(time.Now())
+	return f.File.Fsync(flags)
+}
+
+func (f *tracedFile) Release() {
+	defer func(start time.Time) { f.fs.observe("Release", f.name, start, fuse.OK) }(time.Now())
+	f.File.Release()
+}
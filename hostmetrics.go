@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.sia.tech/siad/modules"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+)
+
+// hostDialTimeout bounds the time taken to connect to a host.
+const hostDialTimeout = time.Minute
+
+var (
+	hostDialDuration = newHistogramVec("user_host_dial_duration_seconds", "Latency of connecting to each host.", latencyBuckets, "host")
+	hostDialErrors   = newCounterVec("user_host_dial_errors_total", "Failed attempts to connect to each host.", "host")
+	hostRPCDuration  = newHistogramVec("user_host_rpc_duration_seconds", "Latency of requests to each host, from sending a request to receiving the first byte of its response.", latencyBuckets, "host")
+	hostBytes        = newCounterVec("user_host_bytes_total", "Bytes exchanged with each host.", "host", "direction")
+)
+
+// A meteredHKR is a renter.HostKeyResolver that records per-host metrics.
+// The download machinery doesn't report which hosts it contacts, so the
+// connections themselves are measured instead: ResolveHostKey connects to
+// the host, and returns the address of a local proxy that relays a single
+// connection to it. Since every session resolves its host immediately before
+// dialing, the session connects through the proxy, and a failure to connect
+// is reported by ResolveHostKey with its original error.
+type meteredHKR struct {
+	hkr renter.HostKeyResolver
+}
+
+// ResolveHostKey implements renter.HostKeyResolver.
+func (m meteredHKR) ResolveHostKey(hostKey hostdb.HostPublicKey) (modules.NetAddress, error) {
+	addr, err := m.hkr.ResolveHostKey(hostKey)
+	if err != nil {
+		return "", err
+	}
+	host := hostKey.ShortKey()
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", string(addr), hostDialTimeout)
+	if err != nil {
+		hostDialErrors.inc(host)
+		return "", err
+	}
+	hostDialDuration.since(start, host)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	go proxyHostConn(l, conn, host)
+	return modules.NetAddress(l.Addr().String()), nil
+}
+
+// proxyHostConn accepts a single connection on l and relays it to conn,
+// which is connected to host. If no connection arrives within
+// hostDialTimeout, conn is closed.
+func proxyHostConn(l net.Listener, conn net.Conn, host string) {
+	defer conn.Close()
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(hostDialTimeout))
+	client, err := l.Accept()
+	l.Close()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	// when either side closes, close both, so that the other relay stops
+	var t rpcTimer
+	done := make(chan struct{})
+	go func() {
+		relayHostConn(conn, client, host, "sent", t.request)
+		client.Close()
+		conn.Close()
+		close(done)
+	}()
+	relayHostConn(client, conn, host, "received", func() { t.response(host) })
+	client.Close()
+	conn.Close()
+	<-done
+}
+
+// relayHostConn copies data from src to dst until either fails, calling
+// onData whenever data arrives.
+func relayHostConn(dst, src net.Conn, host, direction string, onData func()) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			onData()
+			hostBytes.add(float64(n), host, direction)
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// An rpcTimer measures the round trip of each request sent over a host
+// connection: from the first data sent after the previous response, to the
+// first data received.
+type rpcTimer struct {
+	mu    sync.Mutex
+	start time.Time // zero if no request is outstanding
+}
+
+func (t *rpcTimer) request() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.start.IsZero() {
+		t.start = time.Now()
+	}
+}
+
+func (t *rpcTimer) response(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.start.IsZero() {
+		hostRPCDuration.since(t.start, host)
+		t.start = time.Time{}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"go.sia.tech/siad/modules"
+	"lukechampine.com/us/hostdb"
+)
+
+func histogramCount(h *histogramVec, labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hist, ok := h.hists[strings.Join(labelValues, "\xff")]; ok {
+		return hist.count
+	}
+	return 0
+}
+
+func counterValue(c *counterVec, labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[strings.Join(labelValues, "\xff")]
+}
+
+func TestMeteredHKR(t *testing.T) {
+	// a "host" that responds to each line with "pong"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s := bufio.NewScanner(conn)
+				for s.Scan() {
+					conn.Write([]byte("pong\n"))
+				}
+			}()
+		}
+	}()
+
+	hostKey := hostdb.HostPublicKey("ed25519:0123456789abcdef")
+	host := hostKey.ShortKey()
+	hkr := meteredHKR{mapHKR{hostKey: modules.NetAddress(l.Addr().String())}}
+	dials := histogramCount(hostDialDuration, host)
+	rpcs := histogramCount(hostRPCDuration, host)
+	sent := counterValue(hostBytes, host, "sent")
+	received := counterValue(hostBytes, host, "received")
+
+	addr, err := hkr.ResolveHostKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	} else if addr == modules.NetAddress(l.Addr().String()) {
+		t.Fatal("expected address of proxy")
+	}
+	conn, err := net.Dial("tcp", string(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	for i := 0; i < 3; i++ {
+		if _, err := conn.Write([]byte("ping\n")); err != nil {
+			t.Fatal(err)
+		} else if resp, err := r.ReadString('\n'); err != nil || resp != "pong\n" {
+			t.Fatal(resp, err)
+		}
+	}
+	conn.Close()
+
+	if n := histogramCount(hostDialDuration, host) - dials; n != 1 {
+		t.Errorf("expected 1 dial, got %v", n)
+	}
+	if n := histogramCount(hostRPCDuration, host) - rpcs; n != 3 {
+		t.Errorf("expected 3 RPCs, got %v", n)
+	}
+	if n := counterValue(hostBytes, host, "sent") - sent; n != 15 {
+		t.Errorf("expected 15 bytes sent, got %v", n)
+	}
+	if n := counterValue(hostBytes, host, "received") - received; n != 15 {
+		t.Errorf("expected 15 bytes received, got %v", n)
+	}
+
+	// the proxy only accepts one connection
+	if conn, err := net.Dial("tcp", string(addr)); err == nil {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("expected proxy to be closed")
+		}
+		conn.Close()
+	}
+}
+
+func TestMeteredHKRDialError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	hostKey := hostdb.HostPublicKey("ed25519:fedcba9876543210")
+	host := hostKey.ShortKey()
+	errs := counterValue(hostDialErrors, host)
+	hkr := meteredHKR{mapHKR{hostKey: modules.NetAddress(addr)}}
+	if _, err := hkr.ResolveHostKey(hostKey); err == nil {
+		t.Fatal("expected dial error")
+	} else if errnoFor(err) != fuse.Status(syscall.EAGAIN) {
+		t.Errorf("expected EAGAIN for %v, got %v", err, errnoFor(err))
+	}
+	if n := counterValue(hostDialErrors, host) - errs; n != 1 {
+		t.Errorf("expected 1 dial error, got %v", n)
+	}
+	if _, err := hkr.ResolveHostKey("ed25519:unknown"); err == nil {
+		t.Fatal("expected error for unknown host")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMetaFileHandler(t *testing.T) {
+	root := t.TempDir()
+	write := func(name, contents string) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.jpg"+metafileExt, "metafile")
+	write("meta/b.txt"+metafileExt, "nested metafile")
+	write("secret.txt", "not a metafile")
+	if err := os.Symlink(filepath.Join(root, "a.jpg"+metafileExt), filepath.Join(root, "link"+metafileExt)); err != nil {
+		t.Fatal(err)
+	}
+	mh := &metaFileHandler{
+		h: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("data"))
+		}),
+		root: root,
+	}
+	do := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mh.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	tests := []struct {
+		target string
+		code   int
+		body   string
+	}{
+		{"/a.jpg", http.StatusOK, "data"},
+		{"/a.jpg?metafile", http.StatusOK, "metafile"},
+		{"/a.jpg?archive=zip&metafile=", http.StatusOK, "metafile"},
+		{"/meta/b.txt?metafile", http.StatusOK, "nested metafile"}, // a directory named "meta" is not special
+		{"/meta/b.txt", http.StatusOK, "data"},
+		{"/secret.txt?metafile", http.StatusNotFound, ""},
+		{"/secret?metafile", http.StatusNotFound, ""},
+		{"/meta?metafile", http.StatusNotFound, ""},
+		{"/link?metafile", http.StatusNotFound, ""},
+		{"/../a.jpg?metafile", http.StatusOK, "metafile"},
+	}
+	for _, test := range tests {
+		rec := do(http.MethodGet, test.target)
+		if rec.Code != test.code {
+			t.Errorf("%v: expected %v, got %v", test.target, test.code, rec.Code)
+		} else if test.body != "" && rec.Body.String() != test.body {
+			t.Errorf("%v: expected %q, got %q", test.target, test.body, rec.Body.String())
+		}
+	}
+
+	rec := do(http.MethodGet, "/a.jpg?metafile")
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename=a.jpg.usa` {
+		t.Errorf("wrong Content-Disposition %q", cd)
+	}
+	if rec := do(http.MethodHead, "/a.jpg?metafile"); rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("HEAD: got %v with %v bytes", rec.Code, rec.Body.Len())
+	}
+	if rec := do(http.MethodPut, "/a.jpg?metafile"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("PUT: expected %v, got %v", http.StatusMethodNotAllowed, rec.Code)
+	}
+}
+
+func TestMetaFileURLName(t *testing.T) {
+	tests := []struct {
+		url  string
+		name string
+	}{
+		{"https://example.com/photos/a.jpg?metafile", "a.jpg" + metafileExt},
+		{"https://u:p@example.com/photos/a.jpg?metafile=1", "a.jpg" + metafileExt},
+		{"https://example.com/share/1.2.sig/photos/a.jpg?metafile", "a.jpg" + metafileExt},
+		{"https://example.com/meta/photos/a.jpg" + metafileExt, "a.jpg" + metafileExt},
+		{"https://example.com/photos/a.jpg" + metafileExt, "a.jpg" + metafileExt},
+		{"https://example.com/photos/a.jpg", ""},
+		{"https://example.com/?metafile", ""},
+	}
+	for _, test := range tests {
+		name, err := metaFileURLName(test.url)
+		if test.name == "" && err == nil {
+			t.Errorf("%v: expected error, got %q", test.url, name)
+		} else if test.name != "" && name != test.name {
+			t.Errorf("%v: expected %q, got %q (%v)", test.url, test.name, name, err)
+		}
+	}
+}
+
+func TestMetaPathHandler(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "photos"), 0700); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(root, "photos", "a.jpg"+metafileExt), []byte("metafile"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(root, "secret.txt"), []byte("not a metafile"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mh := metaPathHandler{root: root}
+	tests := []struct {
+		method string
+		target string
+		code   int
+	}{
+		{http.MethodGet, "/meta/photos/a.jpg" + metafileExt, http.StatusOK},
+		{http.MethodHead, "/meta/photos/a.jpg" + metafileExt, http.StatusOK},
+		{http.MethodGet, "/meta/photos/../photos/a.jpg" + metafileExt, http.StatusOK},
+		{http.MethodGet, "/meta/photos/a.jpg", http.StatusNotFound},
+		{http.MethodGet, "/meta/photos/", http.StatusNotFound},
+		{http.MethodGet, "/meta/secret.txt", http.StatusNotFound},
+		{http.MethodGet, "/meta/../secret.txt", http.StatusNotFound},
+		{http.MethodPut, "/meta/photos/a.jpg" + metafileExt, http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		mh.ServeHTTP(rec, httptest.NewRequest(test.method, test.target, nil))
+		if rec.Code != test.code {
+			t.Errorf("%v %v: expected %v, got %v", test.method, test.target, test.code, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+var (
+	httpRequests = newCounterVec("user_http_requests_total", "Number of HTTP requests served.", "endpoint", "method", "code")
+	httpErrors   = newCounterVec("user_http_errors_total", "Number of HTTP requests that failed, by type of failure.", "endpoint", "type")
+	httpDuration = newHistogramVec("user_http_request_duration_seconds", "Latency of HTTP requests, until the response is complete.", latencyBuckets, "endpoint")
+	httpBytes    = newCounterVec("user_http_response_bytes_total", "Bytes sent in HTTP response bodies.", "endpoint")
+
+	// openFiles is the number of PseudoFiles currently opened by serve.
+	openFiles int64
+	_         = newGaugeFunc("user_http_open_files", "Number of files currently open for downloads or uploads.", func() float64 {
+		return float64(atomic.LoadInt64(&openFiles))
+	})
+)
+
+// A countedFile decrements openFiles when closed.
+type countedFile struct {
+	http.File
+	closed int32
+}
+
+func newCountedFile(f http.File) *countedFile {
+	atomic.AddInt64(&openFiles, 1)
+	return &countedFile{File: f}
+}
+
+func (f *countedFile) Close() error {
+	if atomic.CompareAndSwapInt32(&f.closed, 0, 1) {
+		atomic.AddInt64(&openFiles, -1)
+	}
+	return f.File.Close()
+}
+
+// httpEndpoint returns the name of the endpoint that serves req, for use as a
+// metric label.
+func httpEndpoint(req *http.Request) string {
+	for _, e := range []struct{ prefix, name string }{
+		{sharePrefix, "share"},
+		{apiPrefix, "api"},
+		{davPrefix, "dav"},
+		{metaPrefix, "meta"},
+	} {
+		if strings.HasPrefix(req.URL.Path, e.prefix) {
+			return e.name
+		}
+	}
+	if isMetaFileQuery(req) {
+		return "meta"
+	}
+	return "files"
+}
+
+// errorType classifies err, an error encountered while serving a request,
+// for use as a metric label. Like errnoFor, it distinguishes problems with
+// hosts from local ones.
+func errorType(err error) string {
+	switch errnoFor(err) {
+	case fuse.ENOENT:
+		return "not_found"
+	case fuse.EACCES, fuse.EPERM, fuse.EROFS:
+		return "forbidden"
+	case fuse.Status(syscall.ENOSPC):
+		return "no_space"
+	case fuse.Status(syscall.EAGAIN):
+		return "host_unavailable"
+	case fuse.Status(syscall.ETIMEDOUT):
+		return "host_timeout"
+	case fuse.Status(syscall.EEXIST), fuse.Status(syscall.ENOTEMPTY), fuse.Status(syscall.EISDIR), fuse.Status(syscall.ENOTDIR), fuse.EINVAL:
+		return "invalid"
+	default:
+		return "io_error"
+	}
+}
+
+// httpErrorType classifies a failed response for which no error was noted,
+// for use as a metric label.
+func httpErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "unauthorized"
+	case status == http.StatusForbidden:
+		return "forbidden"
+	case status == http.StatusNotFound:
+		return "not_found"
+	case status == http.StatusTooManyRequests:
+		return "rate_limited"
+	case status == http.StatusServiceUnavailable:
+		return "unavailable"
+	case status >= 500:
+		return "server_error"
+	default:
+		return "client_error"
+	}
+}
+
+// A metricsHandler records metrics for each request. If endpoint is empty,
+// it is inferred from the request path.
+type metricsHandler struct {
+	h        http.Handler
+	endpoint string
+}
+
+// ServeHTTP implements http.Handler.
+func (mh *metricsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	endpoint := mh.endpoint
+	if endpoint == "" {
+		endpoint = httpEndpoint(req)
+	}
+	req, rn := withRequestNote(req)
+	sr := &statusRecorder{ResponseWriter: w}
+	aborted := true
+	defer func() {
+		// runs even if the handler panics (e.g. with http.ErrAbortHandler)
+		status := sr.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		code := strconv.Itoa(status)
+		if aborted {
+			code = "aborted"
+		}
+		// prefer the cause of the failure, if known; a noted error may
+		// also interrupt a response that has already begun successfully
+		if errType := rn.getErrorType(); errType != "" {
+			httpErrors.inc(endpoint, errType)
+		} else if aborted {
+			httpErrors.inc(endpoint, "aborted")
+		} else if status >= 400 {
+			httpErrors.inc(endpoint, httpErrorType(status))
+		}
+		httpRequests.inc(endpoint, req.Method, code)
+		httpBytes.add(float64(sr.bytes), endpoint)
+		httpDuration.since(start, endpoint)
+	}()
+	mh.h.ServeHTTP(sr, req)
+	aborted = false
+}
+
+// A fileServer is an http.FileServer that notes the errors encountered while
+// opening and reading files, so that metricsHandler can classify them.
+type fileServer struct {
+	fs http.FileSystem
+}
+
+// ServeHTTP implements http.Handler.
+func (fsrv fileServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	http.FileServer(errorNotingFS{fsrv.fs, req}).ServeHTTP(w, req)
+}
+
+// An errorNotingFS is an http.FileSystem that notes errors encountered while
+// serving req.
+type errorNotingFS struct {
+	fs  http.FileSystem
+	req *http.Request
+}
+
+// Open implements http.FileSystem.
+func (nfs errorNotingFS) Open(name string) (http.File, error) {
+	f, err := nfs.fs.Open(name)
+	if err != nil {
+		// missing files are reported by status code (and FileServer probes
+		// for index.html in every directory)
+		if !os.IsNotExist(err) {
+			noteError(nfs.req, err)
+		}
+		return nil, err
+	}
+	return errorNotingFile{f, nfs.req}, nil
+}
+
+// An errorNotingFile is an http.File that notes errors encountered while
+// reading it in response to req.
+type errorNotingFile struct {
+	http.File
+	req *http.Request
+}
+
+// Read implements http.File.
+func (f errorNotingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if err != nil && err != io.EOF {
+		noteError(f.req, err)
+	}
+	return n, err
+}
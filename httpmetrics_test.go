@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestErrorType(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{os.ErrNotExist, "not_found"},
+		{errors.Wrap(os.ErrPermission, "could not open"), "forbidden"},
+		{&os.PathError{Op: "mkdir", Path: "foo", Err: syscall.EEXIST}, "invalid"},
+		{errors.New("could not connect to host: connection refused"), "host_unavailable"},
+		{errors.New("read tcp: i/o timeout"), "host_timeout"},
+		{errors.New("insufficient funds"), "no_space"},
+		{errors.New("something else"), "io_error"},
+	}
+	for _, test := range tests {
+		if got := errorType(test.err); got != test.want {
+			t.Errorf("%v: expected %v, got %v", test.err, test.want, got)
+		}
+	}
+}
+
+// A failingFS serves files whose contents can't be read, as if their hosts
+// were unreachable.
+type failingFS struct {
+	http.Dir
+}
+
+func (fs failingFS) Open(name string) (http.File, error) {
+	f, err := fs.Dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return failingFile{f}, nil
+}
+
+type failingFile struct {
+	http.File
+}
+
+func (failingFile) Read([]byte) (int, error) {
+	return 0, errors.New("could not connect to host")
+}
+
+func TestMetricsHandlerErrors(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "file"), []byte("hello, world"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		endpoint string
+		h        http.Handler
+		errType  string
+	}{
+		{"test-dav", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			davError(w, req, errors.Wrap(os.ErrNotExist, "could not open"))
+		}), "not_found"},
+		{"test-host", fileServer{failingFS{http.Dir(dir)}}, "host_unavailable"},
+		{"test-missing", fileServer{http.Dir(dir)}, "not_found"},
+		{"test-status", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}), "unauthorized"},
+		{"test-aborted", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			panic(http.ErrAbortHandler)
+		}), "aborted"},
+	}
+	for _, test := range tests {
+		mh := &metricsHandler{h: test.h, endpoint: test.endpoint}
+		target := "/file"
+		if test.endpoint == "test-missing" {
+			target = "/missing"
+		}
+		func() {
+			defer func() { recover() }()
+			mh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+		}()
+		if n := counterValue(httpErrors, test.endpoint, test.errType); n != 1 {
+			t.Errorf("%v: expected 1 %v error, got %v", test.endpoint, test.errType, n)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"lukechampine.com/us/renter/renterutil"
+)
+
+// An uploadHandler accepts file uploads, passing other requests to the
+// underlying handler. A file can be uploaded by PUTting it to its path, or by
+// POSTing a multipart/form-data request containing one or more files to the
+// path of their directory. If writable is false, uploads are rejected.
+type uploadHandler struct {
+	h         http.Handler
+	pfs       *renterutil.PseudoFS
+	root      string
+	minShards int
+	writable  bool
+}
+
+// ServeHTTP implements http.Handler.
+func (uh *uploadHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		uh.h.ServeHTTP(w, req)
+	case http.MethodPut, http.MethodPost:
+		if !uh.writable {
+			http.Error(w, "server is read-only", http.StatusMethodNotAllowed)
+		} else if req.Method == http.MethodPut {
+			uh.put(w, req)
+		} else {
+			uh.post(w, req)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// upload uploads a file, creating its parent directories if necessary, and
+// returns a description of it.
+func (uh *uploadHandler) upload(name string, body io.Reader) (apiFile, error) {
+	dir := path.Dir(name)
+	if err := uh.pfs.MkdirAll(dir, 0755); err != nil {
+		return apiFile{}, err
+	}
+	// PseudoFS checks minShards against the number of hosts
+	minShards, err := dirMinShards(uh.root, dir, uh.minShards, 0)
+	if err != nil {
+		return apiFile{}, err
+	}
+	if err := uploadPseudoFile(uh.pfs, name, body, minShards); err != nil {
+		return apiFile{}, err
+	}
+	info, err := uh.pfs.Stat(name)
+	if err != nil {
+		return apiFile{}, err
+	}
+	return newAPIFile(uh.root, name, info, false), nil
+}
+
+func (uh *uploadHandler) put(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+	if name == "" || strings.HasSuffix(req.URL.Path, "/") {
+		http.Error(w, "PUT requires a file path", http.StatusBadRequest)
+		return
+	}
+	info, err := uh.pfs.Stat(name)
+	if err == nil && info.IsDir() {
+		http.Error(w, "cannot overwrite a directory", http.StatusConflict)
+		return
+	}
+	existed := err == nil
+	f, err := uh.upload(name, req.Body)
+	if err != nil {
+		davError(w, req, err)
+		return
+	}
+	status := http.StatusCreated
+	if existed {
+		status = http.StatusOK
+	}
+	writeJSON(w, status, f)
+}
+
+func (uh *uploadHandler) post(w http.ResponseWriter, req *http.Request) {
+	if mt, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mt != "multipart/form-data" {
+		http.Error(w, "POST requires a multipart/form-data body", http.StatusUnsupportedMediaType)
+		return
+	}
+	dir := strings.TrimPrefix(path.Clean("/"+req.URL.Path), "/")
+	if info, err := uh.pfs.Stat(dir); err == nil && !info.IsDir() {
+		http.Error(w, "POST requires a directory path", http.StatusConflict)
+		return
+	}
+	mr, err := req.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	files := []apiFile{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// files before this point have already been uploaded
+			http.Error(w, "malformed multipart body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// some browsers send the full path of the file on the client
+		filename := part.FileName()
+		if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+			filename = filename[i+1:]
+		}
+		if filename == "" || filename == "." || filename == ".." {
+			part.Close()
+			continue // not a file
+		}
+		f, err := uh.upload(path.Join(dir, filename), part)
+		part.Close()
+		if err != nil {
+			davError(w, req, err)
+			return
+		}
+		files = append(files, f)
+	}
+	writeJSON(w, http.StatusCreated, files)
+}
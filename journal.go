@@ -0,0 +1,771 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/pkg/errors"
+	"lukechampine.com/us/renter/renterutil"
+	"lukechampine.com/us/renterhost"
+)
+
+// journalDelay is how long a staged file must go unmodified before it is
+// uploaded. This avoids uploading files that are about to be rewritten or
+// renamed, as editors and archivers often do.
+const journalDelay = 2 * time.Second
+
+// Failed uploads are retried after uploadRetryDelay, doubling with each
+// attempt. After maxUploadAttempts, the file is left in the journal until the
+// next flush or mount.
+const (
+	uploadRetryDelay  = 30 * time.Second
+	maxUploadAttempts = 5
+)
+
+// A journal stages files written to the FUSE mount on local disk, uploading
+// them to hosts in the background. Staged files are synced to disk whenever
+// they are closed, so they survive crashes: any entries left over from a
+// previous mount are uploaded when the journal is next opened.
+type journal struct {
+	dir  string
+	pfs  *renterutil.PseudoFS
+	root string // metafolder of pfs
+
+	mu         sync.Mutex
+	cond       *sync.Cond // broadcast whenever an entry changes state
+	entries    map[string]*journalEntry
+	queue      []*journalEntry
+	flushing   int
+	flushStart time.Time
+	closed     bool
+	done       chan struct{}
+}
+
+// A journalEntry is a file awaiting upload. Its metadata is stored in
+// <ID>.json and its contents in <ID>.data.
+type journalEntry struct {
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	Mode      os.FileMode `json:"mode"`
+	MinShards int         `json:"minShards"`
+	ModTime   time.Time   `json:"modTime"`       // if zero, use upload time
+	UID       *uint32     `json:"uid,omitempty"` // if nil, leave unchanged
+	GID       *uint32     `json:"gid,omitempty"`
+
+	refs      int // open handles
+	gen       int // incremented whenever the file is modified
+	released  time.Time
+	queued    bool
+	uploading bool
+	attempts  int // failed uploads since the last modification
+	attempted time.Time
+	retryAt   time.Time
+	lastErr   error
+	failed    bool // gave up after maxUploadAttempts
+}
+
+// setOwner sets the owner that e's metafile is given once uploaded. As in
+// chown(2), an ID of -1 leaves the corresponding owner unchanged.
+func (e *journalEntry) setOwner(uid, gid uint32) {
+	if uid != ^uint32(0) {
+		e.UID = &uid
+	}
+	if gid != ^uint32(0) {
+		e.GID = &gid
+	}
+}
+
+// chownID converts an optional ID to the form expected by os.Chown, where -1
+// leaves the owner unchanged.
+func chownID(id *uint32) int {
+	if id == nil {
+		return -1
+	}
+	return int(*id)
+}
+
+// modified records that e has been (or is about to be) modified, so that any
+// upload in progress is repeated and failed uploads get a fresh set of
+// attempts. j.mu must be held.
+func (e *journalEntry) modified() {
+	e.gen++
+	e.attempts = 0
+	e.lastErr = nil
+	e.failed = false
+}
+
+func (j *journal) metaPath(e *journalEntry) string {
+	return filepath.Join(j.dir, e.ID+".json")
+}
+
+func (j *journal) dataPath(e *journalEntry) string {
+	return filepath.Join(j.dir, e.ID+".data")
+}
+
+// save persists e's metadata. j.mu must be held.
+func (j *journal) save(e *journalEntry) error {
+	js, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := j.metaPath(e) + "_tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(js); err != nil {
+		return err
+	} else if err := f.Sync(); err != nil {
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.metaPath(e))
+}
+
+// remove deletes e from the journal. j.mu must be held.
+func (j *journal) remove(e *journalEntry) {
+	if j.entries[e.Name] == e {
+		delete(j.entries, e.Name)
+	}
+	os.Remove(j.metaPath(e))
+	os.Remove(j.dataPath(e))
+	j.cond.Broadcast()
+}
+
+// enqueue queues e for upload. j.mu must be held.
+func (j *journal) enqueue(e *journalEntry) {
+	if !e.queued {
+		e.queued = true
+		j.queue = append(j.queue, e)
+		j.cond.Broadcast()
+	}
+}
+
+// waitUploads waits until no entry matching fn is being uploaded. j.mu must be
+// held. Uploads only start while j.mu is held, so none will start until the
+// caller releases it.
+func (j *journal) waitUploads(fn func(name string) bool) {
+	for {
+		var uploading bool
+		for name, e := range j.entries {
+			uploading = uploading || (e.uploading && fn(name))
+		}
+		if !uploading {
+			return
+		}
+		j.cond.Wait()
+	}
+}
+
+// lookupIdle returns the entry for name, waiting for any in-progress upload
+// of name to complete. If the upload succeeded, the returned entry is nil.
+// j.mu must be held.
+func (j *journal) lookupIdle(name string) *journalEntry {
+	j.waitUploads(func(n string) bool { return n == name })
+	return j.entries[name]
+}
+
+// within reports whether name is dir or is within dir.
+func within(name, dir string) bool {
+	return name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// Staged reports whether name is staged, returning its size and metadata if
+// so.
+func (j *journal) Staged(name string) (*journalEntry, os.FileInfo, bool) {
+	j.mu.Lock()
+	e, ok := j.entries[name]
+	j.mu.Unlock()
+	if !ok {
+		return nil, nil, false
+	}
+	stat, err := os.Stat(j.dataPath(e))
+	return e, stat, err == nil
+}
+
+// Children returns the names of the staged files within dir.
+func (j *journal) Children(dir string) []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var names []string
+	for name := range j.entries {
+		parent := filepath.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+		if parent == dir {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	return names
+}
+
+// Pending returns the number of staged files and their total size.
+func (j *journal) Pending() (files int, bytes int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, e := range j.entries {
+		files++
+		if stat, err := os.Stat(j.dataPath(e)); err == nil {
+			bytes += stat.Size()
+		}
+	}
+	return
+}
+
+// newEntryID returns a random ID for a journal entry.
+func newEntryID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Create stages a new, empty file, replacing any existing staged file with
+// the same name.
+func (j *journal) Create(name string, mode os.FileMode, minShards int) (nodefs.File, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := j.entries[name]
+	if e == nil {
+		id, err := newEntryID()
+		if err != nil {
+			return nil, err
+		}
+		e = &journalEntry{
+			ID:        id,
+			Name:      name,
+			Mode:      mode,
+			MinShards: minShards,
+		}
+		if err := j.save(e); err != nil {
+			return nil, err
+		}
+		j.entries[name] = e
+	}
+	return j.open(e, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+// Stage stages a copy of an uploaded file, read from r, and opens it with
+// flags. e supplies the file's name and metadata; its ID is assigned by Stage.
+// If r is nil, the staged file is empty. If the file is already staged, the
+// staged file is opened instead.
+func (j *journal) Stage(e *journalEntry, r io.Reader, flags int) (nodefs.File, error) {
+	id, err := newEntryID()
+	if err != nil {
+		return nil, err
+	}
+	e.ID = id
+	// copy the data before adding the entry, so that a partial copy is never
+	// uploaded; the copy may take a while, so j.mu is not held
+	if err := j.writeData(e, r); err != nil {
+		os.Remove(j.dataPath(e))
+		return nil, err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if staged := j.entries[e.Name]; staged != nil {
+		os.Remove(j.dataPath(e))
+		return j.open(staged, flags)
+	}
+	if err := j.save(e); err != nil {
+		os.Remove(j.dataPath(e))
+		return nil, err
+	}
+	j.entries[e.Name] = e
+	return j.open(e, flags)
+}
+
+// writeData writes the contents of r to the data file of e.
+func (j *journal) writeData(e *journalEntry, r io.Reader) error {
+	f, err := os.OpenFile(j.dataPath(e), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if r != nil {
+		buf := make([]byte, renterhost.SectorSize)
+		if _, err := io.CopyBuffer(f, r, buf); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Open opens a staged file. If name is not staged, it returns (nil, nil).
+// Opening a file that is being uploaded does not wait for the upload; if the
+// file is modified, it is uploaded again once closed.
+func (j *journal) Open(name string, flags int) (nodefs.File, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := j.entries[name]
+	if e == nil {
+		return nil, nil
+	}
+	return j.open(e, flags)
+}
+
+// open opens the data file of e. j.mu must be held.
+func (j *journal) open(e *journalEntry, flags int) (nodefs.File, error) {
+	f, err := os.OpenFile(j.dataPath(e), flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0 {
+		e.modified()
+	}
+	e.refs++
+	return &stagedFile{
+		File: nodefs.NewLoopbackFile(f),
+		j:    j,
+		e:    e,
+	}, nil
+}
+
+// release decrements the reference count of e, queueing it for upload if
+// there are no remaining references.
+func (j *journal) release(e *journalEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e.refs--
+	if e.refs == 0 && j.entries[e.Name] == e {
+		e.released = time.Now()
+		j.enqueue(e)
+	}
+}
+
+// Remove removes name from the journal, reporting whether it was staged.
+func (j *journal) Remove(name string) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := j.lookupIdle(name)
+	if e != nil {
+		j.remove(e)
+	}
+	return e != nil
+}
+
+// RemoveDir removes the uploaded directory dir using remove, along with any
+// staged files within it.
+func (j *journal) RemoveDir(dir string, remove func() error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	inDir := func(name string) bool { return within(name, dir) }
+	j.waitUploads(inDir)
+	if err := remove(); err != nil {
+		return err
+	}
+	for name, e := range j.entries {
+		if inDir(name) {
+			j.remove(e)
+		}
+	}
+	return nil
+}
+
+// Rename renames a staged file, reporting whether it was staged.
+func (j *journal) Rename(oldName, newName string) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.waitUploads(func(name string) bool { return name == oldName || name == newName })
+	e := j.entries[oldName]
+	if e == nil {
+		return false, nil
+	}
+	if old := j.entries[newName]; old != nil {
+		j.remove(old)
+	}
+	delete(j.entries, oldName)
+	e.Name = newName
+	j.entries[newName] = e
+	return true, j.save(e)
+}
+
+// RenameUploaded renames oldName, an uploaded file or directory, to newName
+// using rename. Any staged file at newName is replaced, and any staged files
+// within oldName are moved along with it. Uploads of the affected entries
+// are completed first, and no others start until rename returns; otherwise,
+// they could be uploaded to their old names after the rename.
+func (j *journal) RenameUploaded(oldName, newName string, rename func() error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.waitUploads(func(name string) bool { return name == newName || within(name, oldName) })
+	if err := rename(); err != nil {
+		return err
+	}
+	if e := j.entries[newName]; e != nil {
+		j.remove(e) // stale
+	}
+	var moved []*journalEntry
+	for name, e := range j.entries {
+		if within(name, oldName) {
+			delete(j.entries, name)
+			e.Name = newName + strings.TrimPrefix(name, oldName)
+			moved = append(moved, e)
+		}
+	}
+	for _, e := range moved {
+		if old := j.entries[e.Name]; old != nil {
+			j.remove(old)
+		}
+		j.entries[e.Name] = e
+		if err := j.save(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update modifies the metadata of a staged file, reporting whether it was
+// staged.
+func (j *journal) Update(name string, fn func(e *journalEntry)) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := j.entries[name]
+	if e == nil {
+		return false, nil
+	}
+	e.modified()
+	fn(e)
+	return true, j.save(e)
+}
+
+// updateEntry modifies the metadata of e, which is open.
+func (j *journal) updateEntry(e *journalEntry, fn func(e *journalEntry)) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.entries[e.Name] != e {
+		return nil // removed while open
+	}
+	e.modified()
+	fn(e)
+	return j.save(e)
+}
+
+// Truncate resizes a staged file, reporting whether it was staged.
+func (j *journal) Truncate(name string, size int64) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := j.entries[name]
+	if e == nil {
+		return false, nil
+	}
+	e.modified()
+	if e.refs == 0 {
+		e.released = time.Now()
+		j.enqueue(e)
+	}
+	return true, os.Truncate(j.dataPath(e), size)
+}
+
+// upload copies e to the PseudoFS, returning once its data is stored on
+// hosts.
+func (j *journal) upload(e *journalEntry) error {
+	f, err := os.Open(j.dataPath(e))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	pf, err := j.pfs.OpenFile(e.Name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, e.Mode, e.MinShards)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, renterhost.SectorSize*e.MinShards)
+	if _, err := io.CopyBuffer(pf, f, buf); err != nil {
+		pf.Close()
+		return err
+	} else if err := pf.Sync(); err != nil {
+		pf.Close()
+		return err
+	} else if err := pf.Close(); err != nil {
+		return err
+	}
+	if !e.ModTime.IsZero() {
+		if err := setModTime(j.pfs, j.root, e.Name, e.ModTime); err != nil {
+			return err
+		}
+	}
+	if e.UID != nil || e.GID != nil {
+		metaPath := filepath.Join(j.root, e.Name+metafileExt)
+		return os.Lchown(metaPath, chownID(e.UID), chownID(e.GID))
+	}
+	return nil
+}
+
+func (j *journal) run() {
+	defer close(j.done)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for {
+		for len(j.queue) == 0 && !j.closed {
+			j.cond.Wait()
+		}
+		if j.closed {
+			return
+		}
+		e := j.queue[0]
+		j.queue = j.queue[1:]
+		e.queued = false
+		if e.refs > 0 || j.entries[e.Name] != e || e.failed {
+			continue // reopened, removed, or given up on
+		}
+		wait := time.Until(e.retryAt)
+		if j.flushing > 0 {
+			// try each file at least once per flush, without waiting
+			if e.attempted.Before(j.flushStart) {
+				wait = 0
+			}
+		} else if settle := journalDelay - time.Since(e.released); settle > wait {
+			wait = settle
+		}
+		if wait > 0 {
+			j.enqueue(e)
+			time.AfterFunc(wait, func() {
+				j.mu.Lock()
+				j.cond.Broadcast()
+				j.mu.Unlock()
+			})
+			j.cond.Wait()
+			continue
+		}
+
+		// the file may be reopened, modified, or have its metadata changed
+		// during the upload, so upload a snapshot of the entry
+		snapshot, gen := *e, e.gen
+		e.uploading = true
+		j.mu.Unlock()
+		err := j.upload(&snapshot)
+		j.mu.Lock()
+		e.uploading = false
+		e.attempted = time.Now()
+		switch {
+		case err != nil:
+			e.attempts++
+			e.lastErr = err
+			if e.attempts >= maxUploadAttempts {
+				log.Printf("Upload of %v failed %v times, giving up until the next flush or mount: %v", e.Name, e.attempts, err)
+				e.failed = true
+			} else {
+				delay := uploadRetryDelay << uint(e.attempts-1)
+				log.Printf("Upload of %v failed, will retry in %v: %v", e.Name, delay, err)
+				e.retryAt = time.Now().Add(delay)
+				j.enqueue(e)
+			}
+		case e.gen != gen:
+			// modified during the upload; upload it again once it's closed
+			if e.refs == 0 {
+				j.enqueue(e)
+			}
+		default:
+			j.remove(e)
+		}
+		j.cond.Broadcast()
+	}
+}
+
+// Flush uploads all closed files, returning once each has either been
+// uploaded or failed to upload. Files that are still open are not uploaded.
+// Files that fail remain in the journal, and their uploads continue to be
+// retried in the background.
+func (j *journal) Flush() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// skip the upload and retry delays while flushing
+	j.flushing++
+	defer func() { j.flushing-- }()
+	start := time.Now()
+	j.flushStart = start
+	for _, e := range j.entries {
+		if e.failed && e.refs == 0 {
+			e.failed = false
+			e.attempts = 0
+			j.enqueue(e)
+		}
+	}
+	j.cond.Broadcast()
+	for !j.closed {
+		var pending bool
+		var failed []string
+		for _, e := range j.entries {
+			if e.refs > 0 {
+				continue
+			} else if e.lastErr != nil && !e.attempted.Before(start) && !e.uploading {
+				failed = append(failed, e.Name)
+			} else {
+				pending = true
+			}
+		}
+		if !pending {
+			if len(failed) > 0 {
+				sort.Strings(failed)
+				return errors.Errorf("could not upload %v staged files (%v); they remain in the journal", len(failed), strings.Join(failed, ", "))
+			}
+			return nil
+		}
+		j.cond.Wait()
+	}
+	return errors.New("journal closed")
+}
+
+// Close stops uploading. Files that have not been uploaded remain in the
+// journal.
+func (j *journal) Close() error {
+	j.mu.Lock()
+	j.closed = true
+	j.cond.Broadcast()
+	j.mu.Unlock()
+	<-j.done
+	return nil
+}
+
+func newJournal(dir string, pfs *renterutil.PseudoFS, root string) (*journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	j := &journal{
+		dir:     dir,
+		pfs:     pfs,
+		root:    root,
+		entries: make(map[string]*journalEntry),
+		done:    make(chan struct{}),
+	}
+	j.cond = sync.NewCond(&j.mu)
+
+	// recover entries from a previous mount
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		js, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		e := new(journalEntry)
+		if err := json.Unmarshal(js, e); err != nil {
+			return nil, errors.Wrapf(err, "could not read journal entry %v", info.Name())
+		}
+		if _, err := os.Stat(j.dataPath(e)); os.IsNotExist(err) {
+			j.remove(e)
+			continue
+		}
+		j.entries[e.Name] = e
+		j.queue = append(j.queue, e)
+	}
+	if len(j.queue) > 0 {
+		log.Printf("Recovered %v unfinished uploads from the journal", len(j.queue))
+	}
+	go j.run()
+	return j, nil
+}
+
+// journalDir returns the journal directory for metaDir within baseDir. Each
+// metafolder gets its own journal, so that staged files are always uploaded to
+// the correct metafolder. If baseDir is empty, a default location is used.
+func journalDir(baseDir, metaDir string) string {
+	if baseDir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			cacheDir = os.TempDir()
+		}
+		baseDir = filepath.Join(cacheDir, "user", "journal")
+	}
+	abs, err := filepath.Abs(metaDir)
+	if err != nil {
+		abs = metaDir
+	}
+	h := sha256.Sum256([]byte(abs))
+	return filepath.Join(baseDir, hex.EncodeToString(h[:8]))
+}
+
+// A stagedFile is a file in the journal.
+type stagedFile struct {
+	nodefs.File
+	j *journal
+	e *journalEntry
+}
+
+// Flush implements nodefs.File. Unlike most filesystems, the data is synced
+// to disk, so that it survives a crash.
+func (f *stagedFile) Flush() fuse.Status {
+	if code := f.File.Fsync(0); code != fuse.OK {
+		return code
+	}
+	return f.File.Flush()
+}
+
+// Release implements nodefs.File.
+func (f *stagedFile) Release() {
+	f.File.Release()
+	f.j.release(f.e)
+}
+
+// GetAttr implements nodefs.File. The mode and modification time of the data
+// file are not those of the staged file, so they are replaced with the
+// entry's.
+func (f *stagedFile) GetAttr(out *fuse.Attr) fuse.Status {
+	if code := f.File.GetAttr(out); code != fuse.OK {
+		return code
+	}
+	f.j.mu.Lock()
+	mode, mtime := f.e.Mode, f.e.ModTime
+	uid, gid := f.e.UID, f.e.GID
+	f.j.mu.Unlock()
+	out.Mode = fuse.S_IFREG | uint32(mode.Perm())
+	if !mtime.IsZero() {
+		out.SetTimes(&mtime, &mtime, &mtime)
+	}
+	if uid != nil {
+		out.Uid = *uid
+	}
+	if gid != nil {
+		out.Gid = *gid
+	}
+	return fuse.OK
+}
+
+// Utimens implements nodefs.File.
+func (f *stagedFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	if mtime == nil {
+		return fuse.OK // access times are not tracked
+	}
+	return errToStatus("Utimens", f.e.Name, f.j.updateEntry(f.e, func(e *journalEntry) {
+		e.ModTime = *mtime
+	}))
+}
+
+// Chmod implements nodefs.File.
+func (f *stagedFile) Chmod(perms uint32) fuse.Status {
+	return errToStatus("Chmod", f.e.Name, f.j.updateEntry(f.e, func(e *journalEntry) {
+		e.Mode = os.FileMode(perms)
+	}))
+}
+
+// Chown implements nodefs.File.
+func (f *stagedFile) Chown(uid uint32, gid uint32) fuse.Status {
+	return errToStatus("Chown", f.e.Name, f.j.updateEntry(f.e, func(e *journalEntry) {
+		e.setOwner(uid, gid)
+	}))
+}
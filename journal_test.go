@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestJournalStage(t *testing.T) {
+	dir := t.TempDir()
+	j, err := newJournal(dir, nil, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	uid := uint32(1234)
+	f, err := j.Stage(&journalEntry{
+		Name:      "foo.txt",
+		Mode:      0640,
+		MinShards: 1,
+		UID:       &uid,
+	}, strings.NewReader("hello"), os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, code := f.Write([]byte("j"), 0); code != fuse.OK {
+		t.Fatal(code)
+	}
+	e, stat, ok := j.Staged("foo.txt")
+	if !ok {
+		t.Fatal("expected file to be staged")
+	} else if stat.Size() != 5 {
+		t.Fatal("wrong size:", stat.Size())
+	}
+	if data, err := ioutil.ReadFile(j.dataPath(e)); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "jello" {
+		t.Fatalf("wrong contents: %q", data)
+	}
+
+	// staging a file that is already staged opens the staged file
+	f2, err := j.Stage(&journalEntry{Name: "foo.txt", MinShards: 1}, strings.NewReader("other"), os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if res, code := f2.Read(buf, 0); code != fuse.OK {
+		t.Fatal(code)
+	} else if data, _ := res.Bytes(buf); string(data) != "jello" {
+		t.Fatalf("wrong contents: %q", data)
+	}
+	if infos, _ := ioutil.ReadDir(dir); len(infos) != 2 {
+		t.Fatal("expected one entry in the journal, got", len(infos), "files")
+	}
+
+	// chown applies to the staged file's eventual metafile
+	if code := f.Chown(^uint32(0), 5678); code != fuse.OK {
+		t.Fatal(code)
+	}
+	var attr fuse.Attr
+	if code := f.GetAttr(&attr); code != fuse.OK {
+		t.Fatal(code)
+	} else if attr.Uid != 1234 || attr.Gid != 5678 {
+		t.Fatalf("wrong owner: %v:%v", attr.Uid, attr.Gid)
+	}
+	f.Release()
+	f2.Release()
+}
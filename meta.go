@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -16,17 +20,8 @@ import (
 )
 
 func metainfo(m *renter.MetaFile) {
-	var uploaded int64
-	for _, shard := range m.Shards {
-		for _, s := range shard {
-			uploaded += int64(s.NumSegments * merkle.SegmentSize)
-		}
-	}
+	uploaded, pctFullRedundancy := uploadProgress(m)
 	redundancy := float64(len(m.Hosts)) / float64(m.MinShards)
-	pctFullRedundancy := 100 * float64(uploaded) / (float64(m.Filesize) * redundancy)
-	if m.Filesize == 0 || pctFullRedundancy > 100 {
-		pctFullRedundancy = 100
-	}
 
 	fmt.Printf(`Filesize:   %v
 Redundancy: %v-of-%v (%0.2gx replication)
@@ -39,6 +34,46 @@ Uploaded:   %v (%0.2f%% of full redundancy)
 	}
 }
 
+// uploadProgress returns the number of bytes uploaded for m, summed across
+// all hosts, and the percentage of full redundancy that this represents.
+func uploadProgress(m *renter.MetaFile) (uploaded int64, pct float64) {
+	for _, shard := range m.Shards {
+		for _, s := range shard {
+			uploaded += int64(s.NumSegments * merkle.SegmentSize)
+		}
+	}
+	redundancy := float64(len(m.Hosts)) / float64(m.MinShards)
+	pct = 100 * float64(uploaded) / (float64(m.Filesize) * redundancy)
+	if m.Filesize == 0 || pct > 100 {
+		pct = 100
+	}
+	return uploaded, pct
+}
+
+// fileHealth summarizes the availability of m. A file is "healthy" if every
+// host stores a complete shard, "degraded" if at least MinShards hosts do,
+// and "unavailable" otherwise.
+func fileHealth(m *renter.MetaFile) string {
+	var complete int
+	for _, shard := range m.Shards {
+		var shardSize int64
+		for _, s := range shard {
+			shardSize += int64(s.NumSegments * merkle.SegmentSize)
+		}
+		if shardSize*int64(m.MinShards) >= m.Filesize {
+			complete++
+		}
+	}
+	switch {
+	case complete == len(m.Hosts):
+		return "healthy"
+	case complete >= m.MinShards:
+		return "degraded"
+	default:
+		return "unavailable"
+	}
+}
+
 // filesize returns a string that displays a filesize in human-readable units.
 func filesizeUnits(size int64) string {
 	if size == 0 {
@@ -71,15 +106,52 @@ func uploadmetafile(f *os.File, minShards int, hosts *renterutil.HostSet, metaPa
 	return fs.Close()
 }
 
-func uploadmetadir(dir, metaDir string, hosts *renterutil.HostSet, minShards int) error {
+func uploadmetadir(dir, metaDir string, hosts *renterutil.HostSet, minShards int, deref bool) error {
 	fs := renterutil.NewFileSystem(metaDir, hosts)
 	defer fs.Close()
 
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		fsPath, _ := filepath.Rel(dir, path)
+	visited := make(map[string]bool)
+	if realDir, err := filepath.EvalSymlinks(dir); err == nil {
+		visited[realDir] = true
+	}
+	if err := uploaddir(fs, dir, ".", metaDir, minShards, deref, visited); err != nil {
+		return err
+	}
+	return fs.Close()
+}
+
+// uploaddir uploads the contents of dir to fsDir within fs. Symlinks are
+// either stored as symlink entries within metaDir or, if deref is set,
+// replaced by their targets; visited guards against symlink cycles.
+func uploaddir(fs *renterutil.PseudoFS, dir, fsDir, metaDir string, minShards int, deref bool, visited map[string]bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		rel, _ := filepath.Rel(dir, path)
+		fsPath := filepath.Join(fsDir, rel)
 		if info.IsDir() || err != nil {
 			return fs.MkdirAll(fsPath, 0700)
 		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !deref {
+				target, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				return writeSymlinkEntry(target, filepath.Join(metaDir, fsPath))
+			}
+			realPath, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return err
+			}
+			if info, err = os.Stat(realPath); err != nil {
+				return err
+			} else if info.IsDir() {
+				if visited[realPath] {
+					return nil
+				}
+				visited[realPath] = true
+				return uploaddir(fs, realPath, fsPath, metaDir, minShards, deref, visited)
+			}
+		}
 		f, err := os.Open(path)
 		if err != nil {
 			return err
@@ -96,10 +168,110 @@ func uploadmetadir(dir, metaDir string, hosts *renterutil.HostSet, minShards int
 		defer pf.Close()
 		return trackUpload(pf, f, false)
 	})
-	if err != nil {
+}
+
+// symlinkExt is the extension of symlink entries in a metafolder. A symlink is
+// stored as a regular file containing its target, rather than as an actual
+// symlink: otherwise, anything that reads the metafolder (the FUSE mount,
+// serve, or a plain file server) would follow it, possibly out of the
+// metafolder entirely.
+const symlinkExt = ".uslink"
+
+// readSymlinkEntry returns the target of the symlink entry at path.
+func readSymlinkEntry(path string) (string, error) {
+	target, err := ioutil.ReadFile(path)
+	return string(target), err
+}
+
+// writeSymlinkEntry creates a symlink entry pointing to target for the file
+// at path, replacing any existing entry.
+func writeSymlinkEntry(target, path string) error {
+	tmp := filepath.FromSlash(tempName(filepath.ToSlash(path)))
+	if err := ioutil.WriteFile(tmp, []byte(target), 0666); err != nil {
+		os.Remove(tmp)
 		return err
 	}
-	return fs.Close()
+	return os.Rename(tmp, path+symlinkExt)
+}
+
+// tempPrefix prefixes the names of temporary entries in a metafolder, such as
+// files that are still being uploaded.
+const tempPrefix = ".user-tmp-"
+
+// tempName returns a unique temporary name in the same directory as name.
+func tempName(name string) string {
+	var buf [8]byte
+	rand.Read(buf[:])
+	return path.Join(path.Dir(name), tempPrefix+hex.EncodeToString(buf[:]))
+}
+
+// isMetadataEntry reports whether info, an entry in a metafolder directory,
+// holds metadata rather than a file: a dirConfigFile, a symlink entry, or a
+// temporary entry. Such entries are omitted from listings. Note that info
+// must describe the entry itself, not a PseudoFS file; a file named
+// notes.uslink is stored as notes.uslink.usa, and is not a symlink entry.
+func isMetadataEntry(info os.FileInfo) bool {
+	name := info.Name()
+	return strings.HasPrefix(name, tempPrefix) ||
+		(!info.IsDir() && (name == dirConfigFile || strings.HasSuffix(name, symlinkExt)))
+}
+
+// readDir returns the files and directories within the directory name of
+// pfs, whose metafolder is root. Unlike PseudoFile.Readdir, it skips entries
+// of the metafolder that are not metafiles, such as metadata entries, rather
+// than failing on them.
+func readDir(pfs *renterutil.PseudoFS, root, name string) ([]os.FileInfo, error) {
+	d, err := pfs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	// unlike the metafolder, this includes files that are open but not yet
+	// written to it
+	entries, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(root, filepath.FromSlash(name))
+	seen := make(map[string]bool)
+	var infos []os.FileInfo
+	for _, entry := range entries {
+		if stat, err := os.Lstat(filepath.Join(dir, entry)); err == nil {
+			if isMetadataEntry(stat) {
+				continue
+			} else if !stat.IsDir() {
+				if !stat.Mode().IsRegular() || !strings.HasSuffix(entry, metafileExt) {
+					continue
+				}
+				entry = strings.TrimSuffix(entry, metafileExt)
+			}
+		}
+		if seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		info, err := pfs.Stat(path.Join(name, entry))
+		if os.IsNotExist(errors.Cause(err)) {
+			continue // removed since listing
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// makeSymlink creates a symlink at path pointing to target, replacing any
+// existing symlink at path.
+func makeSymlink(target, path string) error {
+	if old, err := os.Readlink(path); err == nil {
+		if old == target {
+			return nil
+		} else if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, path)
 }
 
 func resumeuploadmetafile(f *os.File, hosts *renterutil.HostSet, metaPath string) error {
@@ -208,17 +380,32 @@ func downloadmetadir(dir string, hosts *renterutil.HostSet, metaDir string) erro
 	defer fs.Close()
 
 	err := filepath.Walk(metaDir, func(metaPath string, info os.FileInfo, err error) error {
-		if info.IsDir() || err != nil {
+		if err != nil || info.IsDir() {
 			return nil
 		}
-		name := strings.TrimSuffix(strings.TrimPrefix(metaPath, metaDir), ".usa")
+		if strings.HasSuffix(metaPath, symlinkExt) {
+			target, err := readSymlinkEntry(metaPath)
+			if err != nil {
+				return err
+			}
+			fpath := filepath.Join(dir, strings.TrimSuffix(strings.TrimPrefix(metaPath, metaDir), symlinkExt))
+			if err := os.MkdirAll(filepath.Dir(fpath), 0700); err != nil {
+				return err
+			}
+			return makeSymlink(target, fpath)
+		} else if !strings.HasSuffix(metaPath, metafileExt) {
+			return nil // e.g. a dirConfigFile
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(metaPath, metaDir), metafileExt)
 		pf, err := fs.Open(name)
 		if err != nil {
 			return err
 		}
 		defer pf.Close()
 		fpath := filepath.Join(dir, name)
-		os.MkdirAll(filepath.Dir(fpath), 0700)
+		if err := os.MkdirAll(filepath.Dir(fpath), 0700); err != nil {
+			return err
+		}
 		f, err := os.OpenFile(fpath, os.O_RDWR|os.O_CREATE, info.Mode())
 		if err != nil {
 			return err
@@ -244,7 +431,7 @@ func migrateDirLocal(dir string, hosts *renterutil.HostSet, metaDir string) erro
 	err := filepath.Walk(metaDir, func(metaPath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
-		} else if info.IsDir() {
+		} else if info.IsDir() || info.Mode()&os.ModeSymlink != 0 || !strings.HasSuffix(metaPath, metafileExt) {
 			return nil
 		}
 		name, _ := filepath.Rel(metaDir, metaPath)
@@ -291,11 +478,11 @@ func migrateDirRemote(hosts *renterutil.HostSet, metaDir string) error {
 	err := filepath.Walk(metaDir, func(metaPath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
-		} else if info.IsDir() {
+		} else if info.IsDir() || info.Mode()&os.ModeSymlink != 0 || !strings.HasSuffix(metaPath, metafileExt) {
 			return nil
 		}
 		fsPath, _ := filepath.Rel(metaDir, metaPath)
-		pf, err := fs.Open(strings.TrimSuffix(fsPath, ".usa"))
+		pf, err := fs.Open(strings.TrimSuffix(fsPath, metafileExt))
 		if err != nil {
 			return errors.Wrap(err, "could not open metafile for reading")
 		}
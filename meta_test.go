@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/renterutil"
+)
+
+func TestIsMetadataEntry(t *testing.T) {
+	dir := t.TempDir()
+	tmp := tempName("foo/bar")
+	if path.Dir(tmp) != "foo" {
+		t.Fatalf("temporary name %q is not alongside foo/bar", tmp)
+	} else if tmp == tempName("foo/bar") {
+		t.Fatal("temporary names are not unique")
+	}
+	tmp = path.Base(tmp)
+	tests := []struct {
+		name  string
+		isDir bool
+		meta  bool
+	}{
+		{"file" + metafileExt, false, false},
+		{"dir", true, false},
+		{dirConfigFile, false, true},
+		{"link" + symlinkExt, false, true},
+		{tmp + metafileExt, false, true},
+		{path.Base(tempName("x")) + "-dir", true, true},
+		// directories are never dirConfigFiles or symlinks
+		{"dir" + symlinkExt, true, false},
+	}
+	for _, test := range tests {
+		p := filepath.Join(dir, test.name)
+		var err error
+		if test.isDir {
+			err = os.Mkdir(p, 0700)
+		} else {
+			err = ioutil.WriteFile(p, nil, 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		} else if isMetadataEntry(info) != test.meta {
+			t.Errorf("%q: expected %v", test.name, test.meta)
+		}
+	}
+}
+
+func TestReadDir(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a.txt", "notes" + symlinkExt, dirConfigFile, "sub/b.txt"} {
+		p := filepath.Join(root, filepath.FromSlash(name)+metafileExt)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := renter.WriteMetaFile(p, renter.NewMetaFile(0644, 0, []hostdb.HostPublicKey{"ed25519:aa"}, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeSymlinkEntry("a.txt", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(root, dirConfigFile), []byte("min_shards = 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(root, tempName("x")), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pfs := renterutil.NewFileSystem(root, renterutil.NewHostSet(nil, 0))
+	defer pfs.Close()
+	infos, err := readDir(pfs, root, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	// files named like metadata entries are listed; the entries themselves
+	// are not
+	exp := []string{dirConfigFile, "a.txt", "notes" + symlinkExt, "sub"}
+	if !reflect.DeepEqual(names, exp) {
+		t.Fatalf("expected %v, got %v", exp, names)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A metric can be written in the Prometheus text exposition format.
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+// A metricsRegistry is a collection of metrics, served over HTTP in the
+// Prometheus text exposition format.
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (r *metricsRegistry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// ServeHTTP implements http.Handler.
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range r.metrics {
+		m.writeTo(w)
+	}
+}
+
+// metrics is the registry for all metrics collected by user.
+var metrics = new(metricsRegistry)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats a set of label names and values, with an optional
+// extra label appended (used for histogram buckets).
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i := range names {
+		pairs = append(pairs, names[i]+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+extra[1]+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a labeled metric in a stable order.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A counterVec is a set of counters, partitioned by label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string][]string // key -> label values
+	counts map[string]float64
+}
+
+// add increments the counter identified by labelValues by v.
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.values[key]; !ok {
+		c.values[key] = labelValues
+	}
+	c.counts[key] += v
+}
+
+func (c *counterVec) inc(labelValues ...string) { c.add(1, labelValues...) }
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%v%v %v\n", c.name, formatLabels(c.labels, c.values[key]), formatFloat(c.counts[key]))
+	}
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string][]string),
+		counts: make(map[string]float64),
+	}
+	metrics.register(c)
+	return c
+}
+
+// A gaugeFunc is a gauge whose value is computed when metrics are collected.
+type gaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n%v %v\n", g.name, g.help, g.name, g.name, formatFloat(g.fn()))
+}
+
+func newGaugeFunc(name, help string, fn func() float64) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	metrics.register(g)
+	return g
+}
+
+// latencyBuckets are the histogram buckets used for latencies, in seconds.
+var latencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10, 30}
+
+type histogram struct {
+	counts []uint64 // one per bucket, non-cumulative
+	sum    float64
+	count  uint64
+}
+
+// A histogramVec is a set of histograms, partitioned by label values.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string][]string
+	hists  map[string]*histogram
+}
+
+// observe records v in the histogram identified by labelValues.
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.hists[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.hists[key] = hist
+		h.values[key] = labelValues
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+// since records the time elapsed since start, in seconds.
+func (h *histogramVec) since(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.values) {
+		hist, values := h.hists[key], h.values[key]
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(h.labels, values, "le", formatFloat(b)), cumulative)
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.name, formatLabels(h.labels, values), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.name, formatLabels(h.labels, values), hist.count)
+	}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string][]string),
+		hists:   make(map[string]*histogram),
+	}
+	metrics.register(h)
+	return h
+}
+
+// serveMetrics serves metrics on addr in the background.
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go srv.Serve(l)
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetricsFormat(t *testing.T) {
+	c := &counterVec{
+		name:   "test_total",
+		help:   "A test counter.",
+		labels: []string{"op"},
+		values: make(map[string][]string),
+		counts: make(map[string]float64),
+	}
+	c.inc("Read")
+	c.add(2, "Read")
+	c.inc(`a"b`)
+	h := &histogramVec{
+		name:    "test_seconds",
+		help:    "A test histogram.",
+		labels:  []string{"host"},
+		buckets: []float64{0.1, 1},
+		values:  make(map[string][]string),
+		hists:   make(map[string]*histogram),
+	}
+	h.observe(0.05, "h1")
+	h.observe(0.5, "h1")
+	h.observe(5, "h1")
+
+	var buf bytes.Buffer
+	c.writeTo(&buf)
+	h.writeTo(&buf)
+	exp := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{op="Read"} 3
+test_total{op="a\"b"} 1
+# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{host="h1",le="0.1"} 1
+test_seconds_bucket{host="h1",le="1"} 2
+test_seconds_bucket{host="h1",le="+Inf"} 3
+test_seconds_sum{host="h1"} 5.55
+test_seconds_count{host="h1"} 3
+`
+	if got := buf.String(); got != exp {
+		t.Errorf("wrong output:\n%v\nexpected:\n%v", got, exp)
+	}
+	if s := formatLabels(nil, nil); s != "" {
+		t.Errorf("expected no labels, got %q", s)
+	}
+}
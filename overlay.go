@@ -0,0 +1,364 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+)
+
+// A mountSource is a metafolder to be mounted, along with the name it should
+// appear under.
+type mountSource struct {
+	name    string
+	metaDir string
+}
+
+// memberCacheTTL is how long a union remembers which filesystem contains a
+// name. Only the primary is modified through the union, but the others may
+// change underneath it.
+const memberCacheTTL = time.Second
+
+// maxMemberCache bounds the number of names a union remembers.
+const maxMemberCache = 10000
+
+type memberCacheEntry struct {
+	fs      *fuseFS
+	expires time.Time
+}
+
+// An overlayFS presents multiple fuseFSs as a single filesystem, either as
+// subdirectories of the root or merged into a single tree (a "union"). Only the
+// primary filesystem is writable.
+type overlayFS struct {
+	pathfs.FileSystem
+	names   []string // primary first
+	members map[string]*fuseFS
+	primary *fuseFS
+	union   bool
+
+	cacheMu sync.Mutex
+	cache   map[string]memberCacheEntry // union only
+}
+
+// member returns the filesystem containing name, along with the name relative
+// to that filesystem. In subdirectory mode, the root itself belongs to no
+// filesystem, and member returns nil.
+func (o *overlayFS) member(name string) (*fuseFS, string) {
+	if o.union {
+		return o.unionMember(name), name
+	}
+	parts := strings.SplitN(name, "/", 2)
+	fs, ok := o.members[parts[0]]
+	if !ok {
+		return nil, ""
+	}
+	if len(parts) == 1 {
+		return fs, ""
+	}
+	return fs, parts[1]
+}
+
+// unionMember returns the first filesystem containing name, or the primary if
+// none do. Every FUSE operation looks up its name, so recent results are
+// cached.
+func (o *overlayFS) unionMember(name string) *fuseFS {
+	o.cacheMu.Lock()
+	e, ok := o.cache[name]
+	o.cacheMu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.fs
+	}
+	fs := o.primary
+	for _, n := range o.names {
+		if o.members[n].exists(name) {
+			fs = o.members[n]
+			break
+		}
+	}
+	o.cacheMu.Lock()
+	if len(o.cache) >= maxMemberCache {
+		o.cache = make(map[string]memberCacheEntry)
+	}
+	o.cache[name] = memberCacheEntry{fs, time.Now().Add(memberCacheTTL)}
+	o.cacheMu.Unlock()
+	return fs
+}
+
+// forget clears the member cache. It is called after removing or renaming
+// files in the primary, which may uncover files in other filesystems.
+func (o *overlayFS) forget() {
+	if o.union {
+		o.cacheMu.Lock()
+		o.cache = make(map[string]memberCacheEntry)
+		o.cacheMu.Unlock()
+	}
+}
+
+// writable returns the filesystem that should be modified for name, along with
+// the name relative to that filesystem. If name is not writable, it returns a
+// non-OK status.
+func (o *overlayFS) writable(name string) (*fuseFS, string, fuse.Status) {
+	if o.union {
+		if fs, _ := o.member(name); fs != o.primary {
+			return nil, "", fuse.EROFS
+		}
+		return o.primary, name, fuse.OK
+	}
+	fs, rel := o.member(name)
+	if fs == nil || rel == "" {
+		return nil, "", fuse.EPERM
+	} else if fs != o.primary {
+		return nil, "", fuse.EROFS
+	}
+	return fs, rel, fuse.OK
+}
+
+// GetAttr implements pathfs.FileSystem.
+func (o *overlayFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if !o.union && name == "" {
+		now := time.Now()
+		attr := &fuse.Attr{
+			Mode:  fuse.S_IFDIR | 0755,
+			Owner: *fuse.CurrentOwner(),
+		}
+		attr.SetTimes(&now, &now, &now)
+		return attr, fuse.OK
+	}
+	fs, rel := o.member(name)
+	if fs == nil {
+		return nil, fuse.ENOENT
+	}
+	return fs.GetAttr(rel, context)
+}
+
+// OpenDir implements pathfs.FileSystem.
+func (o *overlayFS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	if !o.union {
+		if name == "" {
+			entries := make([]fuse.DirEntry, len(o.names))
+			for i, n := range o.names {
+				entries[i] = fuse.DirEntry{Name: n, Mode: fuse.S_IFDIR}
+			}
+			return entries, fuse.OK
+		}
+		fs, rel := o.member(name)
+		if fs == nil {
+			return nil, fuse.ENOENT
+		}
+		return fs.OpenDir(rel, context)
+	}
+	// merge the listings of each filesystem, preferring earlier ones
+	seen := make(map[string]bool)
+	var entries []fuse.DirEntry
+	code := fuse.ENOENT
+	for _, n := range o.names {
+		dirEntries, c := o.members[n].OpenDir(name, context)
+		if c != fuse.OK {
+			continue
+		}
+		code = fuse.OK
+		for _, e := range dirEntries {
+			if !seen[e.Name] {
+				seen[e.Name] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, code
+}
+
+// Open implements pathfs.FileSystem.
+func (o *overlayFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE != 0 {
+		fs, rel, code := o.writable(name)
+		if code != fuse.OK {
+			return nil, code
+		}
+		return fs.Open(rel, flags, context)
+	}
+	fs, rel := o.member(name)
+	if fs == nil {
+		return nil, fuse.ENOENT
+	}
+	return fs.Open(rel, flags, context)
+}
+
+// Create implements pathfs.FileSystem.
+func (o *overlayFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	fs, rel, code := o.writable(name)
+	if code != fuse.OK {
+		return nil, code
+	}
+	return fs.Create(rel, flags, mode, context)
+}
+
+// Unlink implements pathfs.FileSystem.
+func (o *overlayFS) Unlink(name string, context *fuse.Context) fuse.Status {
+	fs, rel, code := o.writable(name)
+	if code != fuse.OK {
+		return code
+	}
+	defer o.forget()
+	return fs.Unlink(rel, context)
+}
+
+// Rename implements pathfs.FileSystem.
+func (o *overlayFS) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	oldFS, oldRel, code := o.writable(oldName)
+	if code != fuse.OK {
+		return code
+	}
+	newFS, newRel, code := o.writable(newName)
+	if code != fuse.OK {
+		return code
+	} else if oldFS != newFS {
+		return fuse.EXDEV
+	}
+	defer o.forget()
+	return oldFS.Rename(oldRel, newRel, context)
+}
+
+// Mkdir implements pathfs.FileSystem.
+func (o *overlayFS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	fs, rel, code := o.writable(name)
+	if code != fuse.OK {
+		return code
+	}
+	return fs.Mkdir(rel, mode, context)
+}
+
+// Rmdir implements pathfs.FileSystem.
+func (o *overlayFS) Rmdir(name string, context *fuse.Context) fuse.Status {
+	fs, rel, code := o.writable(name)
+	if code != fuse.OK {
+		return code
+	}
+	defer o.forget()
+	return fs.Rmdir(rel, context)
+}
+
+// Chmod implements pathfs.FileSystem.
+func (o *overlayFS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	fs, rel, code := o.writable(name)
+	if code != fuse.OK {
+		return code
+	}
+	return fs.Chmod(rel, mode, context)
+}
+
+// Chown implements pathfs.FileSystem.
+func (o *overlayFS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	fs, rel, code := o.writable(name)
+	if code != fuse.OK {
+		return code
+	}
+	return fs.Chown(rel, uid, gid, context)
+}
+
+// Utimens implements pathfs.FileSystem.
+func (o *overlayFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	fs, rel, code := o.writable(name)
+	if code != fuse.OK {
+		return code
+	}
+	return fs.Utimens(rel, atime, mtime, context)
+}
+
+// Truncate implements pathfs.FileSystem.
+func (o *overlayFS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	fs, rel, code := o.writable(name)
+	if code != fuse.OK {
+		return code
+	}
+	return fs.Truncate(rel, size, context)
+}
+
+// Symlink implements pathfs.FileSystem.
+func (o *overlayFS) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	fs, rel, code := o.writable(linkName)
+	if code != fuse.OK {
+		return code
+	}
+	return fs.Symlink(value, rel, context)
+}
+
+// Readlink implements pathfs.FileSystem.
+func (o *overlayFS) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	fs, rel := o.member(name)
+	if fs == nil {
+		return "", fuse.ENOENT
+	}
+	return fs.Readlink(rel, context)
+}
+
+// GetXAttr implements pathfs.FileSystem.
+func (o *overlayFS) GetXAttr(name string, attr string, context *fuse.Context) ([]byte, fuse.Status) {
+	fs, rel := o.member(name)
+	if fs == nil {
+		return nil, fuse.ENOATTR
+	}
+	return fs.GetXAttr(rel, attr, context)
+}
+
+// ListXAttr implements pathfs.FileSystem.
+func (o *overlayFS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	fs, rel := o.member(name)
+	if fs == nil {
+		return nil, fuse.OK
+	}
+	return fs.ListXAttr(rel, context)
+}
+
+// SetXAttr implements pathfs.FileSystem.
+func (o *overlayFS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	// unlike other modifications, this is permitted on the root of the
+	// primary filesystem
+	fs, rel := o.member(name)
+	if fs == nil {
+		return fuse.EPERM
+	} else if fs != o.primary {
+		return fuse.EROFS
+	}
+	return fs.SetXAttr(rel, attr, data, flags, context)
+}
+
+// RemoveXAttr implements pathfs.FileSystem.
+func (o *overlayFS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	// unlike other modifications, this is permitted on the root of the
+	// primary filesystem
+	fs, rel := o.member(name)
+	if fs == nil {
+		return fuse.EPERM
+	} else if fs != o.primary {
+		return fuse.EROFS
+	}
+	return fs.RemoveXAttr(rel, attr, context)
+}
+
+// StatFs implements pathfs.FileSystem.
+func (o *overlayFS) StatFs(name string) *fuse.StatfsOut {
+	return o.primary.StatFs("")
+}
+
+func newOverlayFS(sources []mountSource, members []*fuseFS, union bool) *overlayFS {
+	o := &overlayFS{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		members:    make(map[string]*fuseFS),
+		primary:    members[0],
+		union:      union,
+		cache:      make(map[string]memberCacheEntry),
+	}
+	for i, src := range sources {
+		o.names = append(o.names, src.name)
+		o.members[src.name] = members[i]
+	}
+	return o
+}
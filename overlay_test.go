@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnionMember(t *testing.T) {
+	dirs := []string{t.TempDir(), t.TempDir()}
+	touch := func(dir, name string) {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	touch(dirs[0], "both"+metafileExt)
+	touch(dirs[1], "both"+metafileExt)
+	touch(dirs[1], "second"+metafileExt)
+	touch(dirs[1], "sub/file"+metafileExt)
+	touch(dirs[1], "link"+symlinkExt)
+
+	sources := []mountSource{{"primary", dirs[0]}, {"other", dirs[1]}}
+	members := []*fuseFS{fileSystem(nil, dirs[0], 1), fileSystem(nil, dirs[1], 1)}
+	o := newOverlayFS(sources, members, true)
+	tests := []struct {
+		name string
+		fs   *fuseFS
+	}{
+		{"", members[0]},
+		{"both", members[0]},
+		{"second", members[1]},
+		{"sub", members[1]},
+		{"sub/file", members[1]},
+		{"link", members[1]},
+		{"missing", members[0]},
+	}
+	for _, test := range tests {
+		if fs, _ := o.member(test.name); fs != test.fs {
+			t.Errorf("%q: wrong member", test.name)
+		}
+	}
+
+	// removing a file from the primary uncovers the other member's file,
+	// once the cache is cleared
+	if err := os.Remove(filepath.Join(dirs[0], "both"+metafileExt)); err != nil {
+		t.Fatal(err)
+	}
+	if fs, _ := o.member("both"); fs != members[0] {
+		t.Error("expected cached member")
+	}
+	o.forget()
+	if fs, _ := o.member("both"); fs != members[1] {
+		t.Error("expected other member after forget")
+	}
+	if _, _, code := o.writable("both"); code.Ok() {
+		t.Error("expected non-primary file to be read-only")
+	}
+}
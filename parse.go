@@ -5,7 +5,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+
+	"github.com/pkg/errors"
 )
 
 // assume metafiles have this extension
@@ -93,3 +96,68 @@ func parseCheckup(args []string, cmd *flag.FlagSet) (metaPath string) {
 	}
 	return args[0]
 }
+
+// parseFilesize parses a human-readable filesize, such as "10GB" or
+// "512 MiB". It is the inverse of filesizeUnits.
+func parseFilesize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"B", 1},
+	}
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.suffix)) {
+			s, mult = strings.TrimSpace(s[:len(s)-len(u.suffix)]), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid filesize %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// parseMountSources parses a list of metafolders, each optionally prefixed by
+// the name it should appear under (e.g. "photos=~/meta/photos"). If primary is
+// non-empty, the source with that name is moved to the front; the order of the
+// others is preserved.
+func parseMountSources(args []string, primary string) ([]mountSource, error) {
+	sources := make([]mountSource, 0, len(args))
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		src := mountSource{metaDir: arg}
+		if i := strings.IndexByte(arg, '='); i > 0 && !strings.ContainsRune(arg[:i], filepath.Separator) {
+			src.name, src.metaDir = arg[:i], arg[i+1:]
+		} else {
+			src.name = filepath.Base(filepath.Clean(arg))
+		}
+		if src.name == "" || src.name == "." || src.name == ".." || strings.ContainsRune(src.name, '/') {
+			return nil, errors.Errorf("invalid name %q", src.name)
+		} else if seen[src.name] {
+			return nil, errors.Errorf("duplicate name %q; use name=metafolder to disambiguate", src.name)
+		}
+		seen[src.name] = true
+		sources = append(sources, src)
+	}
+	if primary != "" {
+		i := 0
+		for i < len(sources) && sources[i].name != primary {
+			i++
+		}
+		if i == len(sources) {
+			return nil, errors.Errorf("primary %q is not one of the mounted metafolders", primary)
+		}
+		// preserve the order of the others, since it determines precedence
+		// in a union
+		src := sources[i]
+		copy(sources[1:i+1], sources[:i])
+		sources[0] = src
+	}
+	return sources, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMountSourcesPrimary(t *testing.T) {
+	args := []string{"a=/meta/a", "b=/meta/b", "c=/meta/c", "d=/meta/d"}
+	tests := []struct {
+		primary string
+		order   []string
+	}{
+		{"", []string{"a", "b", "c", "d"}},
+		{"a", []string{"a", "b", "c", "d"}},
+		{"c", []string{"c", "a", "b", "d"}},
+		{"d", []string{"d", "a", "b", "c"}},
+	}
+	for _, test := range tests {
+		sources, err := parseMountSources(args, test.primary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var order []string
+		for _, src := range sources {
+			order = append(order, src.name)
+			if src.metaDir != "/meta/"+src.name {
+				t.Errorf("%v has wrong metafolder %v", src.name, src.metaDir)
+			}
+		}
+		if !reflect.DeepEqual(order, test.order) {
+			t.Errorf("primary %q: expected %v, got %v", test.primary, test.order, order)
+		}
+	}
+	if _, err := parseMountSources(args, "e"); err == nil {
+		t.Error("expected error for unknown primary")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A tokenBucket limits the rate of some event. Tokens accrue at rate per
+// second, up to burst.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	if tb.last.IsZero() {
+		tb.tokens = tb.burst
+	} else {
+		tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	}
+	tb.last = now
+}
+
+// take takes n tokens from the bucket, if available. Otherwise, it returns
+// the time until they will be.
+func (tb *tokenBucket) take(n float64, now time.Time) (ok bool, wait time.Duration) {
+	tb.refill(now)
+	if tb.tokens >= n {
+		tb.tokens -= n
+		return true, 0
+	}
+	return false, time.Duration((n - tb.tokens) / tb.rate * float64(time.Second))
+}
+
+// reserve takes n tokens from the bucket, going into debt if necessary, and
+// returns the time until the debt is repaid. Callers that wait for the
+// returned duration are thus served in the order that they called reserve.
+func (tb *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	tb.refill(now)
+	tb.tokens -= n
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// clientAddr returns the IP address of the client that sent req.
+func clientAddr(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// A rateLimitHandler limits the rate of requests from each client, as
+// identified by IP address. Requests exceeding the limit are rejected with
+// 429 Too Many Requests.
+type rateLimitHandler struct {
+	h     http.Handler
+	rate  float64 // requests per second
+	burst int
+
+	mu      sync.Mutex
+	clients map[string]*tokenBucket
+}
+
+// ServeHTTP implements http.Handler.
+func (rh *rateLimitHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	now := time.Now()
+	client := clientAddr(req)
+	rh.mu.Lock()
+	if rh.clients == nil {
+		rh.clients = make(map[string]*tokenBucket)
+	}
+	tb, ok := rh.clients[client]
+	if !ok {
+		// forget clients whose buckets have refilled; they're
+		// indistinguishable from new clients
+		for c, b := range rh.clients {
+			if b.refill(now); b.tokens >= b.burst {
+				delete(rh.clients, c)
+			}
+		}
+		tb = &tokenBucket{rate: rh.rate, burst: float64(rh.burst)}
+		rh.clients[client] = tb
+	}
+	ok, wait := tb.take(1, now)
+	rh.mu.Unlock()
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	rh.h.ServeHTTP(w, req)
+}
+
+// A bandwidthLimiter caps the combined rate of writes to any number of
+// http.ResponseWriters.
+type bandwidthLimiter struct {
+	mu sync.Mutex
+	tb tokenBucket
+}
+
+// limitChunk is the largest write that is passed to the underlying
+// ResponseWriter at once, keeping the output of a limited stream smooth.
+const limitChunk = 32 << 10
+
+func newBandwidthLimiter(bytesPerSec int64) *bandwidthLimiter {
+	burst := float64(bytesPerSec)
+	if burst < limitChunk {
+		burst = limitChunk
+	}
+	return &bandwidthLimiter{
+		tb: tokenBucket{rate: float64(bytesPerSec), burst: burst},
+	}
+}
+
+func (bl *bandwidthLimiter) wait(n int) {
+	bl.mu.Lock()
+	d := bl.tb.reserve(float64(n), time.Now())
+	bl.mu.Unlock()
+	time.Sleep(d)
+}
+
+// A limitedResponseWriter is a ResponseWriter whose writes are subject to a
+// bandwidthLimiter.
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	bl *bandwidthLimiter
+}
+
+func (lw limitedResponseWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > limitChunk {
+			chunk = chunk[:limitChunk]
+		}
+		lw.bl.wait(len(chunk))
+		m, err := lw.ResponseWriter.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// A bandwidthHandler applies a bandwidthLimiter to every response.
+type bandwidthHandler struct {
+	h  http.Handler
+	bl *bandwidthLimiter
+}
+
+// ServeHTTP implements http.Handler.
+func (bh *bandwidthHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	bh.h.ServeHTTP(limitedResponseWriter{w, bh.bl}, req)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// maxPrefetches is the maximum number of blocks of a single file that are
+// downloaded concurrently.
+const maxPrefetches = 4
+
+var errPrefetchCancelled = errors.New("prefetch cancelled")
+
+// A readaheadFile wraps an io.ReaderAt, prefetching blocks in the background
+// when reads are sequential. The number of blocks prefetched starts at one
+// and doubles with each sequential read, up to maxWindow; a non-sequential
+// read resets it, cancelling any prefetches that have not yet started.
+//
+// The kernel issues several reads of a file concurrently, so they may arrive
+// slightly out of order; a read counts as sequential if it starts near the end
+// of the furthest read so far.
+type readaheadFile struct {
+	r         io.ReaderAt
+	size      int64
+	maxWindow int64         // in blocks
+	sem       chan struct{} // limits concurrent downloads
+
+	mu      sync.Mutex
+	window  int64
+	lastOff int64 // end of the furthest read in the current sequence
+	blocks  map[int64]*prefetchBlock
+	closed  bool
+}
+
+type prefetchBlock struct {
+	done   chan struct{}
+	cancel chan struct{}
+	data   []byte
+	err    error
+}
+
+// fetch returns the block at index i, starting a download if necessary.
+// raf.mu must be held.
+func (raf *readaheadFile) fetch(i int64) *prefetchBlock {
+	if b, ok := raf.blocks[i]; ok {
+		return b
+	}
+	off := i * cacheBlockSize
+	length := raf.size - off
+	if length > cacheBlockSize {
+		length = cacheBlockSize
+	}
+	b := &prefetchBlock{
+		done:   make(chan struct{}),
+		cancel: make(chan struct{}),
+		data:   make([]byte, length),
+	}
+	raf.blocks[i] = b
+	go func() {
+		defer close(b.done)
+		select {
+		case raf.sem <- struct{}{}:
+			defer func() { <-raf.sem }()
+		case <-b.cancel:
+			b.err = errPrefetchCancelled
+			return
+		}
+		// the block may have been cancelled while waiting
+		select {
+		case <-b.cancel:
+			b.err = errPrefetchCancelled
+			return
+		default:
+		}
+		_, b.err = raf.r.ReadAt(b.data, off)
+		if b.err == io.EOF {
+			b.err = nil
+		}
+	}()
+	return b
+}
+
+// discard cancels and forgets the block at index i. raf.mu must be held.
+func (raf *readaheadFile) discard(i int64) {
+	close(raf.blocks[i].cancel)
+	delete(raf.blocks, i)
+}
+
+// reset discards all blocks and shrinks the window. raf.mu must be held.
+func (raf *readaheadFile) reset() {
+	for i := range raf.blocks {
+		raf.discard(i)
+	}
+	raf.window = 0
+}
+
+// ReadAt implements io.ReaderAt.
+func (raf *readaheadFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= raf.size {
+		return 0, io.EOF
+	}
+	raf.mu.Lock()
+	if raf.closed {
+		raf.mu.Unlock()
+		return raf.r.ReadAt(p, off)
+	}
+	const slack = cacheBlockSize
+	sequential := raf.lastOff-slack <= off && off <= raf.lastOff+slack
+	if sequential {
+		if raf.window == 0 {
+			raf.window = 1
+		} else if raf.window *= 2; raf.window > raf.maxWindow {
+			raf.window = raf.maxWindow
+		}
+	} else {
+		raf.reset()
+	}
+	first := off / cacheBlockSize
+	last := (off + int64(len(p)) - 1) / cacheBlockSize
+	if lastBlock := (raf.size - 1) / cacheBlockSize; last > lastBlock {
+		last = lastBlock
+	}
+	// discard blocks that are no longer useful, keeping the previous block
+	// for any concurrent reads that are slightly behind
+	for i := range raf.blocks {
+		if i < first-1 || i > last+raf.window {
+			raf.discard(i)
+		}
+	}
+	blocks := make([]*prefetchBlock, 0, last-first+1)
+	for i := first; i <= last; i++ {
+		blocks = append(blocks, raf.fetch(i))
+	}
+	for i := last + 1; i <= last+raf.window && i*cacheBlockSize < raf.size; i++ {
+		raf.fetch(i)
+	}
+	raf.mu.Unlock()
+
+	var n int
+	for i, b := range blocks {
+		<-b.done
+		data, err := b.data, b.err
+		if err == errPrefetchCancelled {
+			// discarded by a concurrent read; download it ourselves
+			data = make([]byte, len(b.data))
+			if _, err = raf.r.ReadAt(data, (first+int64(i))*cacheBlockSize); err == io.EOF {
+				err = nil
+			}
+		}
+		if err != nil {
+			raf.mu.Lock()
+			raf.reset()
+			raf.mu.Unlock()
+			return n, err
+		}
+		start := (off + int64(n)) % cacheBlockSize
+		if start >= int64(len(data)) {
+			break // end of file
+		}
+		n += copy(p[n:], data[start:])
+	}
+
+	raf.mu.Lock()
+	if end := off + int64(n); !sequential || end > raf.lastOff {
+		raf.lastOff = end
+	}
+	raf.mu.Unlock()
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close cancels any pending prefetches. Subsequent reads are passed directly
+// to the underlying io.ReaderAt.
+func (raf *readaheadFile) Close() error {
+	raf.mu.Lock()
+	defer raf.mu.Unlock()
+	raf.reset()
+	raf.closed = true
+	return nil
+}
+
+func newReadaheadFile(r io.ReaderAt, size int64, maxWindow int64) *readaheadFile {
+	return &readaheadFile{
+		r:         r,
+		size:      size,
+		maxWindow: maxWindow,
+		sem:       make(chan struct{}, maxPrefetches),
+		blocks:    make(map[int64]*prefetchBlock),
+	}
+}
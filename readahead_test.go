@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A countingReaderAt records the offsets it is asked to read, optionally
+// blocking each read until unblock is closed.
+type countingReaderAt struct {
+	r       io.ReaderAt
+	unblock chan struct{}
+
+	mu    sync.Mutex
+	reads []int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	c.reads = append(c.reads, off)
+	c.mu.Unlock()
+	if c.unblock != nil {
+		<-c.unblock
+	}
+	return c.r.ReadAt(p, off)
+}
+
+func (c *countingReaderAt) numReads() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.reads)
+}
+
+func TestReadaheadSequential(t *testing.T) {
+	data := make([]byte, 20*cacheBlockSize+999)
+	rand.Read(data)
+	cr := &countingReaderAt{r: bytes.NewReader(data)}
+	raf := newReadaheadFile(cr, int64(len(data)), 8)
+	defer raf.Close()
+
+	// read sequentially, in kernel-sized requests that arrive slightly out
+	// of order
+	const reqSize = 128 << 10
+	var got []byte
+	for off := int64(0); off < int64(len(data)); off += 2 * reqSize {
+		a := make([]byte, reqSize)
+		b := make([]byte, reqSize)
+		nb, _ := raf.ReadAt(b, off+reqSize)
+		na, _ := raf.ReadAt(a, off)
+		got = append(got, a[:na]...)
+		got = append(got, b[:nb]...)
+		if off > 4*cacheBlockSize && raf.window < 2 {
+			t.Fatalf("window was reset by out-of-order read at %v", off)
+		}
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("sequential reads returned wrong data")
+	}
+	// each block should have been downloaded exactly once
+	if n := cr.numReads(); n != 21 {
+		t.Fatalf("expected 21 block downloads, got %v", n)
+	}
+
+	// a random read resets the window
+	p := make([]byte, 1000)
+	if _, err := raf.ReadAt(p, 3*cacheBlockSize+17); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data[3*cacheBlockSize+17:][:1000]) {
+		t.Fatal("random read returned wrong data")
+	} else if raf.window != 0 {
+		t.Fatal("random read did not reset window")
+	}
+}
+
+func TestReadaheadCancel(t *testing.T) {
+	data := make([]byte, 64*cacheBlockSize)
+	cr := &countingReaderAt{r: bytes.NewReader(data), unblock: make(chan struct{})}
+	raf := newReadaheadFile(cr, int64(len(data)), 32)
+	raf.window = 16 // as if many sequential reads had occurred
+	raf.mu.Lock()
+	for i := int64(0); i < 32; i++ {
+		raf.fetch(i)
+	}
+	raf.mu.Unlock()
+	// wait for the first downloads to start
+	for cr.numReads() < maxPrefetches {
+		time.Sleep(time.Millisecond)
+	}
+	raf.Close()
+	close(cr.unblock)
+	time.Sleep(50 * time.Millisecond)
+	if n := cr.numReads(); n != maxPrefetches {
+		t.Fatalf("expected only %v downloads to start, got %v", maxPrefetches, n)
+	}
+
+	// reads after Close bypass the prefetcher
+	p := make([]byte, 10)
+	if _, err := raf.ReadAt(p, 5); err != nil {
+		t.Fatal(err)
+	}
+}
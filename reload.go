@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.sia.tech/siad/modules"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/renterutil"
+)
+
+// A syncHKR is a renter.HostKeyResolver whose addresses can be updated while
+// in use.
+type syncHKR struct {
+	mu sync.RWMutex
+	m  mapHKR
+}
+
+// ResolveHostKey implements renter.HostKeyResolver.
+func (s *syncHKR) ResolveHostKey(hpk hostdb.HostPublicKey) (modules.NetAddress, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m.ResolveHostKey(hpk)
+}
+
+// update adds or replaces the addresses in m. Hosts absent from m are
+// retained, since existing metafiles may still refer to them.
+func (s *syncHKR) update(m mapHKR) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hpk, addr := range m {
+		s.m[hpk] = addr
+	}
+}
+
+// A hostSetReloader tracks the contracts on the muse server, building a new
+// HostSet whenever they change. A HostSet cannot safely be modified while it
+// is in use, so rather than updating the live HostSet, the caller swaps in
+// the new one (see generationSwapper).
+type hostSetReloader struct {
+	hkr      *syncHKR
+	resolver renter.HostKeyResolver // wraps hkr
+
+	mu        sync.Mutex
+	contracts map[hostdb.HostPublicKey]renter.Contract
+}
+
+// reload fetches the current contracts from muse. If any hosts were added or
+// any contracts renewed, it returns a new HostSet containing every contract;
+// otherwise, it returns nil. Hosts absent from muse are retained, since
+// existing metafiles may still refer to them.
+func (r *hostSetReloader) reload() (*renterutil.HostSet, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	contracts, addrs, err := fetchContracts()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get contracts")
+	}
+	r.hkr.update(addrs)
+	updated := make(map[hostdb.HostPublicKey]renter.Contract, len(r.contracts))
+	for hostKey, c := range r.contracts {
+		updated[hostKey] = c
+	}
+	var added, renewed int
+	for _, c := range contracts {
+		old, ok := updated[c.HostKey]
+		if ok && old.ID == c.ID {
+			continue
+		} else if ok {
+			renewed++
+		} else {
+			added++
+		}
+		updated[c.HostKey] = c
+	}
+	if added == 0 && renewed == 0 {
+		return nil, nil
+	}
+	currentHeight, err := getCurrentHeight()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get current height")
+	}
+	hs := renterutil.NewHostSet(r.resolver, currentHeight)
+	for _, c := range updated {
+		hs.AddHost(c)
+	}
+	r.contracts = updated
+	log.Printf("Reloaded contracts: %v new hosts, %v renewed contracts", added, renewed)
+	return hs, nil
+}
+
+// makeReloadableHostSet is like makeHostSet, but the returned
+// hostSetReloader can build replacements for the HostSet as contracts
+// change. If metered is true, per-host metrics are recorded.
+func makeReloadableHostSet(metered bool) (*renterutil.HostSet, *hostSetReloader) {
+	contracts, addrs, err := fetchContracts()
+	check("Could not get contracts:", err)
+	hkr := &syncHKR{m: addrs}
+	var resolver renter.HostKeyResolver = hkr
+	if metered {
+		resolver = meteredHKR{hkr}
+	}
+	hs := newHostSet(contracts, resolver)
+	r := &hostSetReloader{
+		hkr:       hkr,
+		resolver:  resolver,
+		contracts: make(map[hostdb.HostPublicKey]renter.Contract),
+	}
+	for _, c := range contracts {
+		r.contracts[c.HostKey] = c
+	}
+	return hs, r
+}
+
+// A serveGeneration is a set of handlers serving a PseudoFS, which is closed
+// (along with its HostSet and host sessions) once the generation has been
+// replaced and its requests have finished.
+type serveGeneration struct {
+	h      http.Handler
+	s3     http.Handler // may be nil
+	closer io.Closer
+	reqs   sync.WaitGroup
+}
+
+// A generationSwapper holds the current serveGeneration.
+type generationSwapper struct {
+	mu     sync.Mutex
+	cur    *serveGeneration
+	closed bool
+}
+
+// acquire returns the current generation, which remains open until the
+// caller calls g.reqs.Done.
+func (gs *generationSwapper) acquire() *serveGeneration {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	g := gs.cur
+	g.reqs.Add(1)
+	return g
+}
+
+// swap makes g the current generation. The previous generation is closed in
+// the background once its requests have finished. If gs has been closed, g
+// is closed immediately instead.
+func (gs *generationSwapper) swap(g *serveGeneration) {
+	gs.mu.Lock()
+	old := gs.cur
+	if gs.closed {
+		old = g
+	} else {
+		gs.cur = g
+	}
+	gs.mu.Unlock()
+	go func() {
+		// no new requests can acquire old, so Wait cannot race with Add
+		old.reqs.Wait()
+		if err := old.closer.Close(); err != nil {
+			log.Println("Could not close replaced host set:", err)
+		}
+	}()
+}
+
+// close closes the current generation without waiting for its requests.
+func (gs *generationSwapper) close() error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.closed = true
+	return gs.cur.closer.Close()
+}
+
+// A generationHandler serves each request with the current generation's
+// handler (or its S3 handler, if s3 is true).
+type generationHandler struct {
+	gs *generationSwapper
+	s3 bool
+}
+
+// ServeHTTP implements http.Handler.
+func (gh generationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	g := gh.gs.acquire()
+	defer g.reqs.Done()
+	if gh.s3 {
+		g.s3.ServeHTTP(w, req)
+	} else {
+		g.h.ServeHTTP(w, req)
+	}
+}
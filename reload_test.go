@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A testGeneration is a serveGeneration whose handler fails the test if it
+// is used after the generation is closed.
+type testGeneration struct {
+	serveGeneration
+	closed int32
+}
+
+func (tg *testGeneration) Close() error {
+	if !atomic.CompareAndSwapInt32(&tg.closed, 0, 1) {
+		panic("generation closed twice")
+	}
+	return nil
+}
+
+func newTestGeneration(t *testing.T) *testGeneration {
+	tg := new(testGeneration)
+	tg.closer = tg
+	tg.h = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for i := 0; i < 10; i++ {
+			if atomic.LoadInt32(&tg.closed) != 0 {
+				t.Error("generation closed while serving a request")
+				return
+			}
+			time.Sleep(100 * time.Microsecond)
+		}
+	})
+	return tg
+}
+
+func TestGenerationSwapper(t *testing.T) {
+	first := newTestGeneration(t)
+	gs := &generationSwapper{cur: &first.serveGeneration}
+	gh := generationHandler{gs: gs}
+
+	// serve requests while swapping generations
+	gens := []*testGeneration{first}
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				gh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		tg := newTestGeneration(t)
+		gens = append(gens, tg)
+		gs.swap(&tg.serveGeneration)
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+
+	// every replaced generation is eventually closed; the current one is not
+	deadline := time.Now().Add(5 * time.Second)
+	for _, tg := range gens[:len(gens)-1] {
+		for atomic.LoadInt32(&tg.closed) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("replaced generation was not closed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	last := gens[len(gens)-1]
+	if atomic.LoadInt32(&last.closed) != 0 {
+		t.Fatal("current generation was closed")
+	}
+
+	// after closing, the current generation is closed, and any generation
+	// swapped in later is closed instead of being used
+	if err := gs.close(); err != nil {
+		t.Fatal(err)
+	} else if atomic.LoadInt32(&last.closed) == 0 {
+		t.Fatal("current generation was not closed")
+	}
+	late := newTestGeneration(t)
+	gs.swap(&late.serveGeneration)
+	for atomic.LoadInt32(&late.closed) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("generation swapped in after close was not closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,877 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/pkg/errors"
+	"lukechampine.com/us/renter/renterutil"
+)
+
+// An s3Error is an error response defined by the S3 API.
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *s3Error) Error() string { return e.message }
+
+var (
+	errS3AccessDenied       = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errS3AuthMalformed      = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	errS3InvalidAccessKey   = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records."}
+	errS3SignatureMismatch  = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	errS3TimeSkewed         = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	errS3ExpiredURL         = &s3Error{http.StatusForbidden, "AccessDenied", "Request has expired."}
+	errS3NoSuchBucket       = &s3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist."}
+	errS3NoSuchKey          = &s3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errS3NoSuchUpload       = &s3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist."}
+	errS3BucketExists       = &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists."}
+	errS3BucketNotEmpty     = &s3Error{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty."}
+	errS3InvalidBucketName  = &s3Error{http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid."}
+	errS3InvalidKey         = &s3Error{http.StatusBadRequest, "InvalidArgument", "Object keys may not contain empty, '.', or '..' path components."}
+	errS3InvalidArgument    = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument."}
+	errS3InvalidPart        = &s3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found."}
+	errS3InvalidPartOrder   = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order."}
+	errS3MalformedXML       = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed."}
+	errS3IncompleteBody     = &s3Error{http.StatusBadRequest, "IncompleteBody", "The request body is incomplete or malformed."}
+	errS3BadDigest          = &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received."}
+	errS3SHA256Mismatch     = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	errS3NotImplemented     = &s3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+	errS3MethodNotAllowed   = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	errS3InternalError      = &s3Error{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	errS3ServiceUnavailable = &s3Error{http.StatusServiceUnavailable, "ServiceUnavailable", "Too few hosts are reachable. Please try again."}
+)
+
+const s3XMLNS = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+func writeS3XML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeS3Error(w http.ResponseWriter, req *http.Request, err error) {
+	s3err, ok := errors.Cause(err).(*s3Error)
+	if !ok {
+		noteError(req, err)
+		switch cause := errors.Cause(err); {
+		case os.IsNotExist(cause):
+			s3err = errS3NoSuchKey
+		case os.IsPermission(cause):
+			s3err = errS3AccessDenied
+		case errnoFor(err) == fuse.Status(syscall.EAGAIN) || errnoFor(err) == fuse.Status(syscall.ETIMEDOUT):
+			log.Printf("S3 %v %v: %v", req.Method, req.URL.Path, err)
+			s3err = errS3ServiceUnavailable
+		default:
+			log.Printf("S3 %v %v: %v", req.Method, req.URL.Path, err)
+			s3err = errS3InternalError
+		}
+	}
+	writeS3XML(w, s3err.status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: s3err.code, Message: s3err.message, Resource: req.URL.Path})
+}
+
+// An s3Handler implements a subset of the Amazon S3 API on top of a PseudoFS.
+// Buckets are the top-level directories of the metafolder, and objects are
+// the files within them. Only path-style requests are supported.
+type s3Handler struct {
+	pfs       *renterutil.PseudoFS
+	root      string
+	cache     *blockCache
+	minShards int
+	accessKey string
+	secretKey string
+	partsDir  string // staging area for multipart uploads
+	tags      *etagCache
+
+	mu      *sync.Mutex // shared with copies made by withFS
+	uploads map[string]*s3Upload
+}
+
+// An s3Upload is an in-progress multipart upload. Parts are stored on local
+// disk until the upload is completed.
+type s3Upload struct {
+	bucket, key string
+	initiated   time.Time
+	parts       map[int]string // part number -> ETag
+}
+
+// splitS3Path splits a request path into a bucket and key.
+func splitS3Path(p string) (bucket, key string) {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+func validBucket(bucket string) bool {
+	return bucket != "" && bucket != "." && bucket != ".." && !strings.ContainsAny(bucket, `/\`)
+}
+
+// validKey reports whether key can be represented as a path within a bucket.
+// A trailing slash, denoting a "folder" object, is permitted.
+func validKey(key string) bool {
+	for _, seg := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if seg == "" || seg == "." || seg == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// objectETag returns an ETag for the object whose metafile is at metaPath.
+func (sh *s3Handler) objectETag(metaPath string, info os.FileInfo) string {
+	etag, _ := sh.objectMetadata(metaPath, info)
+	return etag
+}
+
+// objectMetadata returns an ETag for the object whose metafile is at
+// metaPath, along with the hosts storing it. Listings request the ETag of
+// every object, so they are cached.
+func (sh *s3Handler) objectMetadata(metaPath string, info os.FileInfo) (string, []string) {
+	etag, hosts, ok := sh.tags.lookup(metaPath)
+	if !ok {
+		// e.g. the file is still being written; fall back to a weaker tag
+		return `"` + strconv.FormatInt(info.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(info.Size(), 16) + `"`, nil
+	}
+	return etag, hosts
+}
+
+// ServeHTTP implements http.Handler.
+func (sh *s3Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := sh.authenticate(req); err != nil {
+		writeS3Error(w, req, err)
+		return
+	}
+	bucket, key := splitS3Path(req.URL.Path)
+	query := req.URL.Query()
+	_, hasUploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+	var err error
+	switch {
+	case bucket == "" && req.Method == http.MethodGet:
+		err = sh.listBuckets(w)
+	case bucket == "":
+		err = errS3MethodNotAllowed
+	case !validBucket(bucket):
+		err = errS3InvalidBucketName
+	case key == "":
+		switch _, hasLocation := query["location"]; {
+		case req.Method == http.MethodGet && hasLocation:
+			writeS3XML(w, http.StatusOK, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				XMLNS   string   `xml:"xmlns,attr"`
+			}{XMLNS: s3XMLNS})
+		case req.Method == http.MethodGet && hasUploads:
+			err = sh.listUploads(w, bucket)
+		case req.Method == http.MethodGet:
+			err = sh.listObjects(w, req, bucket)
+		case req.Method == http.MethodHead:
+			err = sh.statBucket(bucket)
+		case req.Method == http.MethodPut:
+			err = sh.createBucket(bucket)
+		case req.Method == http.MethodDelete:
+			err = sh.deleteBucket(bucket)
+			if err == nil {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		case req.Method == http.MethodPost && hasKey(query, "delete"):
+			err = sh.deleteObjects(w, req, bucket)
+		default:
+			err = errS3NotImplemented
+		}
+	case !validKey(key):
+		err = errS3InvalidKey
+	default:
+		switch {
+		case req.Method == http.MethodGet || req.Method == http.MethodHead:
+			err = sh.getObject(w, req, bucket, key)
+		case req.Method == http.MethodPut && uploadID != "":
+			err = sh.uploadPart(w, req, bucket, key, uploadID)
+		case req.Method == http.MethodPut && req.Header.Get("X-Amz-Copy-Source") != "":
+			err = errS3NotImplemented
+		case req.Method == http.MethodPut:
+			err = sh.putObject(w, req, bucket, key)
+		case req.Method == http.MethodDelete && uploadID != "":
+			err = sh.abortUpload(bucket, key, uploadID)
+			if err == nil {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		case req.Method == http.MethodDelete:
+			err = sh.deleteObject(bucket, key)
+			if err == nil {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		case req.Method == http.MethodPost && hasUploads:
+			err = sh.initiateUpload(w, bucket, key)
+		case req.Method == http.MethodPost && uploadID != "":
+			err = sh.completeUpload(w, req, bucket, key, uploadID)
+		default:
+			err = errS3NotImplemented
+		}
+	}
+	if err != nil {
+		writeS3Error(w, req, err)
+	}
+}
+
+func hasKey(query map[string][]string, key string) bool {
+	_, ok := query[key]
+	return ok
+}
+
+// s3Time formats t as S3 does in XML responses.
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func (sh *s3Handler) statBucket(bucket string) error {
+	info, err := sh.pfs.Stat(bucket)
+	if err != nil || !info.IsDir() {
+		return errS3NoSuchBucket
+	}
+	return nil
+}
+
+func (sh *s3Handler) listBuckets(w http.ResponseWriter) error {
+	dir, err := sh.pfs.Open("")
+	if err != nil {
+		return err
+	}
+	infos, err := dir.Readdir(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	var resp struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		XMLNS   string   `xml:"xmlns,attr"`
+		Owner   struct {
+			ID          string
+			DisplayName string
+		}
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}
+	resp.XMLNS = s3XMLNS
+	resp.Owner.ID, resp.Owner.DisplayName = "user", "user"
+	for _, info := range infos {
+		if info.IsDir() && validBucket(info.Name()) {
+			resp.Buckets = append(resp.Buckets, bucket{info.Name(), s3Time(info.ModTime())})
+		}
+	}
+	writeS3XML(w, http.StatusOK, resp)
+	return nil
+}
+
+func (sh *s3Handler) createBucket(bucket string) error {
+	if _, err := sh.pfs.Stat(bucket); err == nil {
+		return errS3BucketExists
+	}
+	return sh.pfs.Mkdir(bucket, 0755)
+}
+
+func (sh *s3Handler) deleteBucket(bucket string) error {
+	if err := sh.statBucket(bucket); err != nil {
+		return err
+	}
+	infos, err := readDir(sh.pfs, sh.root, bucket)
+	if err != nil {
+		return err
+	} else if len(infos) > 0 {
+		return errS3BucketNotEmpty
+	}
+	return sh.pfs.RemoveAll(bucket)
+}
+
+// An s3Entry is an object or directory found while listing a bucket.
+type s3Entry struct {
+	key  string // directories end in '/'
+	info os.FileInfo
+}
+
+// walk returns the entries under dir (relative to bucket). If recursive is
+// false, subdirectories are returned as entries rather than descended into.
+func (sh *s3Handler) walk(bucket, dir string, recursive bool) ([]s3Entry, error) {
+	infos, err := readDir(sh.pfs, sh.root, path.Join(bucket, dir))
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []s3Entry
+	for _, info := range infos {
+		key := info.Name()
+		if dir != "" {
+			key = dir + "/" + key
+		}
+		if !info.IsDir() {
+			entries = append(entries, s3Entry{key, info})
+		} else if !recursive {
+			entries = append(entries, s3Entry{key + "/", info})
+		} else {
+			sub, err := sh.walk(bucket, key, true)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, sub...)
+		}
+	}
+	return entries, nil
+}
+
+// listObjects implements both ListObjects and ListObjectsV2.
+func (sh *s3Handler) listObjects(w http.ResponseWriter, req *http.Request, bucket string) error {
+	if err := sh.statBucket(bucket); err != nil {
+		return err
+	}
+	query := req.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := 1000
+	if s := query.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return errS3InvalidArgument
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	marker := query.Get("marker")
+	if v2 {
+		marker = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			b, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return errS3InvalidArgument
+			}
+			marker = string(b)
+		}
+	}
+
+	// only walk the part of the tree that can match prefix; when the
+	// delimiter is '/', there's no need to descend into subdirectories
+	dir := ""
+	if i := strings.LastIndexByte(prefix, '/'); i >= 0 {
+		dir = prefix[:i]
+	}
+	entries, err := sh.walk(bucket, dir, delimiter != "/")
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	type object struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+		StorageClass string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	var resp struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		XMLNS                 string   `xml:"xmlns,attr"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		Marker                string `xml:",omitempty"`
+		NextMarker            string `xml:",omitempty"`
+		StartAfter            string `xml:",omitempty"`
+		ContinuationToken     string `xml:",omitempty"`
+		NextContinuationToken string `xml:",omitempty"`
+		KeyCount              int    `xml:",omitempty"`
+		MaxKeys               int
+		IsTruncated           bool
+		Contents              []object
+		CommonPrefixes        []commonPrefix
+	}
+	resp.XMLNS = s3XMLNS
+	resp.Name, resp.Prefix, resp.Delimiter, resp.MaxKeys = bucket, prefix, delimiter, maxKeys
+	if v2 {
+		resp.StartAfter, resp.ContinuationToken = query.Get("start-after"), query.Get("continuation-token")
+	} else {
+		resp.Marker = marker
+	}
+	var last string
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.key, prefix) {
+			continue
+		}
+		// group keys containing the delimiter (after the prefix)
+		name, isPrefix := e.key, false
+		if delimiter != "" {
+			if i := strings.Index(e.key[len(prefix):], delimiter); i >= 0 {
+				name, isPrefix = e.key[:len(prefix)+i+len(delimiter)], true
+			}
+		}
+		if name <= marker || seen[name] {
+			continue
+		} else if !isPrefix && strings.HasSuffix(name, "/") {
+			continue // directory without a delimiter to group it
+		}
+		if len(resp.Contents)+len(resp.CommonPrefixes) == maxKeys {
+			resp.IsTruncated = true
+			break
+		}
+		seen[name] = true
+		last = name
+		if isPrefix {
+			resp.CommonPrefixes = append(resp.CommonPrefixes, commonPrefix{name})
+		} else {
+			resp.Contents = append(resp.Contents, object{
+				Key:          name,
+				LastModified: s3Time(e.info.ModTime()),
+				ETag:         sh.objectETag(sh.metaPath(bucket, name), e.info),
+				Size:         e.info.Size(),
+				StorageClass: "STANDARD",
+			})
+		}
+	}
+	if v2 {
+		resp.KeyCount = len(resp.Contents) + len(resp.CommonPrefixes)
+		if resp.IsTruncated {
+			resp.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else if resp.IsTruncated && delimiter != "" {
+		resp.NextMarker = last
+	}
+	writeS3XML(w, http.StatusOK, resp)
+	return nil
+}
+
+// metaPath returns the path of the metafile for key.
+func (sh *s3Handler) metaPath(bucket, key string) string {
+	return filepath.Join(sh.root, bucket, filepath.FromSlash(key)) + metafileExt
+}
+
+func (sh *s3Handler) getObject(w http.ResponseWriter, req *http.Request, bucket, key string) error {
+	if err := sh.statBucket(bucket); err != nil {
+		return err
+	}
+	name := path.Join(bucket, key)
+	info, err := sh.pfs.Stat(name)
+	if err != nil || info.IsDir() != strings.HasSuffix(key, "/") {
+		return errS3NoSuchKey
+	}
+	if info.IsDir() {
+		// "folder" object
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+		return nil
+	}
+	f, err := (errorNotingFS{&httpFS{sh.pfs, sh.root, sh.cache}, req}).Open("/" + name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	etag, hosts := sh.objectMetadata(sh.metaPath(bucket, key), info)
+	noteHosts(req, hosts)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, req, key, info.ModTime(), f)
+	return nil
+}
+
+// verifiedReader hashes the data read from r, so that it can be checked
+// against the digests supplied by the client.
+type verifiedReader struct {
+	r      io.Reader
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func (vr *verifiedReader) Read(p []byte) (int, error) {
+	n, err := vr.r.Read(p)
+	vr.md5.Write(p[:n])
+	vr.sha256.Write(p[:n])
+	return n, err
+}
+
+func newVerifiedReader(r io.Reader) *verifiedReader {
+	return &verifiedReader{r: r, md5: md5.New(), sha256: sha256.New()}
+}
+
+// verify checks the data read against the Content-MD5 and
+// X-Amz-Content-Sha256 headers of req.
+func (vr *verifiedReader) verify(req *http.Request) error {
+	if want := req.Header.Get("Content-MD5"); want != "" && want != base64.StdEncoding.EncodeToString(vr.md5.Sum(nil)) {
+		return errS3BadDigest
+	}
+	want := req.Header.Get("X-Amz-Content-Sha256")
+	if len(want) == 64 && want != hex.EncodeToString(vr.sha256.Sum(nil)) {
+		return errS3SHA256Mismatch
+	}
+	return nil
+}
+
+func (sh *s3Handler) putObject(w http.ResponseWriter, req *http.Request, bucket, key string) error {
+	if err := sh.statBucket(bucket); err != nil {
+		return err
+	}
+	name := path.Join(bucket, key)
+	if strings.HasSuffix(key, "/") {
+		// "folder" object
+		io.Copy(ioutil.Discard, req.Body)
+		return sh.pfs.MkdirAll(name, 0755)
+	}
+	if info, err := sh.pfs.Stat(name); err == nil && info.IsDir() {
+		return errS3InvalidKey
+	}
+	if err := sh.pfs.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	// don't replace an existing object until the upload has been verified
+	minShards, err := dirMinShards(sh.root, path.Dir(name), sh.minShards, 0)
+	if err != nil {
+		return err
+	}
+	vr := newVerifiedReader(s3Body(req))
+	tmp, err := stagePseudoFile(sh.pfs, name, vr, minShards)
+	if err != nil {
+		return err
+	} else if err := vr.verify(req); err != nil {
+		sh.pfs.Remove(tmp)
+		return err
+	} else if err := commitPseudoFile(sh.pfs, tmp, name); err != nil {
+		return err
+	}
+	info, err := sh.pfs.Stat(name)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", sh.objectETag(sh.metaPath(bucket, key), info))
+	return nil
+}
+
+func (sh *s3Handler) deleteObject(bucket, key string) error {
+	if err := sh.statBucket(bucket); err != nil {
+		return err
+	}
+	name := path.Join(bucket, key)
+	info, err := sh.pfs.Stat(name)
+	if err != nil {
+		return nil // deleting a nonexistent object is not an error
+	} else if info.IsDir() != strings.HasSuffix(key, "/") {
+		return nil
+	}
+	if info.IsDir() {
+		// "folder" object; its contents are separate objects, so only remove
+		// it if it's empty
+		if os.Remove(filepath.Join(sh.root, filepath.FromSlash(name))) != nil {
+			return nil
+		}
+	} else if err := sh.pfs.Remove(name); err != nil {
+		return err
+	}
+	// remove directories left empty, since S3 has no concept of them
+	for dir := path.Dir(name); dir != bucket && dir != "."; dir = path.Dir(dir) {
+		if os.Remove(filepath.Join(sh.root, filepath.FromSlash(dir))) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (sh *s3Handler) deleteObjects(w http.ResponseWriter, req *http.Request, bucket string) error {
+	if err := sh.statBucket(bucket); err != nil {
+		return err
+	}
+	var body struct {
+		Quiet   bool
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	data, err := readS3Body(req)
+	if err != nil {
+		return err
+	} else if err := xml.Unmarshal(data, &body); err != nil {
+		return errS3MalformedXML
+	}
+	type deleted struct {
+		Key string
+	}
+	type deleteError struct {
+		Key     string
+		Code    string
+		Message string
+	}
+	var resp struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		XMLNS   string   `xml:"xmlns,attr"`
+		Deleted []deleted
+		Errors  []deleteError `xml:"Error"`
+	}
+	resp.XMLNS = s3XMLNS
+	for _, obj := range body.Objects {
+		var err error = errS3InvalidKey
+		if validKey(obj.Key) {
+			err = sh.deleteObject(bucket, obj.Key)
+		}
+		if err != nil {
+			s3err, ok := errors.Cause(err).(*s3Error)
+			if !ok {
+				log.Printf("S3 DELETE %v/%v: %v", bucket, obj.Key, err)
+				s3err = errS3InternalError
+			}
+			resp.Errors = append(resp.Errors, deleteError{obj.Key, s3err.code, s3err.message})
+		} else if !body.Quiet {
+			resp.Deleted = append(resp.Deleted, deleted{obj.Key})
+		}
+	}
+	writeS3XML(w, http.StatusOK, resp)
+	return nil
+}
+
+func (sh *s3Handler) initiateUpload(w http.ResponseWriter, bucket, key string) error {
+	if err := sh.statBucket(bucket); err != nil {
+		return err
+	} else if strings.HasSuffix(key, "/") {
+		return errS3InvalidKey
+	}
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(idBytes)
+	if err := os.MkdirAll(filepath.Join(sh.partsDir, id), 0700); err != nil {
+		return err
+	}
+	sh.mu.Lock()
+	sh.uploads[id] = &s3Upload{
+		bucket:    bucket,
+		key:       key,
+		initiated: time.Now(),
+		parts:     make(map[int]string),
+	}
+	sh.mu.Unlock()
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		XMLNS    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{XMLNS: s3XMLNS, Bucket: bucket, Key: key, UploadId: id})
+	return nil
+}
+
+// upload returns the multipart upload with the given ID.
+func (sh *s3Handler) upload(bucket, key, id string) (*s3Upload, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	u, ok := sh.uploads[id]
+	if !ok || u.bucket != bucket || u.key != key {
+		return nil, errS3NoSuchUpload
+	}
+	return u, nil
+}
+
+func (sh *s3Handler) partPath(id string, n int) string {
+	return filepath.Join(sh.partsDir, id, strconv.Itoa(n))
+}
+
+func (sh *s3Handler) uploadPart(w http.ResponseWriter, req *http.Request, bucket, key, id string) error {
+	u, err := sh.upload(bucket, key, id)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > 10000 {
+		return errS3InvalidArgument
+	}
+	f, err := ioutil.TempFile(filepath.Join(sh.partsDir, id), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	vr := newVerifiedReader(s3Body(req))
+	_, err = io.Copy(f, vr)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	} else if err := vr.verify(req); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), sh.partPath(id, n)); err != nil {
+		return err
+	}
+	etag := `"` + hex.EncodeToString(vr.md5.Sum(nil)) + `"`
+	sh.mu.Lock()
+	u.parts[n] = etag
+	sh.mu.Unlock()
+	w.Header().Set("ETag", etag)
+	return nil
+}
+
+func (sh *s3Handler) completeUpload(w http.ResponseWriter, req *http.Request, bucket, key, id string) error {
+	u, err := sh.upload(bucket, key, id)
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	data, err := readS3Body(req)
+	if err != nil {
+		return err
+	} else if err := xml.Unmarshal(data, &body); err != nil || len(body.Parts) == 0 {
+		return errS3MalformedXML
+	}
+	var readers []io.Reader
+	sh.mu.Lock()
+	for i, p := range body.Parts {
+		etag, ok := u.parts[p.PartNumber]
+		if !ok || strings.Trim(etag, `"`) != strings.Trim(p.ETag, `"`) {
+			sh.mu.Unlock()
+			return errS3InvalidPart
+		} else if i > 0 && p.PartNumber <= body.Parts[i-1].PartNumber {
+			sh.mu.Unlock()
+			return errS3InvalidPartOrder
+		}
+	}
+	sh.mu.Unlock()
+	for _, p := range body.Parts {
+		f, err := os.Open(sh.partPath(id, p.PartNumber))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	name := path.Join(bucket, key)
+	if err := sh.pfs.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	minShards, err := dirMinShards(sh.root, path.Dir(name), sh.minShards, 0)
+	if err != nil {
+		return err
+	}
+	if err := uploadPseudoFile(sh.pfs, name, io.MultiReader(readers...), minShards); err != nil {
+		return err
+	}
+	sh.abortUpload(bucket, key, id)
+	info, err := sh.pfs.Stat(name)
+	if err != nil {
+		return err
+	}
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		XMLNS    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{XMLNS: s3XMLNS, Location: "/" + name, Bucket: bucket, Key: key, ETag: sh.objectETag(sh.metaPath(bucket, key), info)})
+	return nil
+}
+
+func (sh *s3Handler) abortUpload(bucket, key, id string) error {
+	if _, err := sh.upload(bucket, key, id); err != nil {
+		return err
+	}
+	sh.mu.Lock()
+	delete(sh.uploads, id)
+	sh.mu.Unlock()
+	return os.RemoveAll(filepath.Join(sh.partsDir, id))
+}
+
+func (sh *s3Handler) listUploads(w http.ResponseWriter, bucket string) error {
+	if err := sh.statBucket(bucket); err != nil {
+		return err
+	}
+	type upload struct {
+		Key       string
+		UploadId  string
+		Initiated string
+	}
+	var resp struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		XMLNS       string   `xml:"xmlns,attr"`
+		Bucket      string
+		IsTruncated bool
+		Uploads     []upload `xml:"Upload"`
+	}
+	resp.XMLNS, resp.Bucket = s3XMLNS, bucket
+	sh.mu.Lock()
+	for id, u := range sh.uploads {
+		if u.bucket == bucket {
+			resp.Uploads = append(resp.Uploads, upload{u.key, id, s3Time(u.initiated)})
+		}
+	}
+	sh.mu.Unlock()
+	sort.Slice(resp.Uploads, func(i, j int) bool {
+		return resp.Uploads[i].Key < resp.Uploads[j].Key
+	})
+	writeS3XML(w, http.StatusOK, resp)
+	return nil
+}
+
+func newS3Handler(root string, cache *blockCache, minShards int, accessKey, secretKey string) (*s3Handler, error) {
+	partsDir, err := ioutil.TempDir("", "user-s3-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Handler{
+		root:      root,
+		cache:     cache,
+		minShards: minShards,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		partsDir:  partsDir,
+		tags:      new(etagCache),
+		mu:        new(sync.Mutex),
+		uploads:   make(map[string]*s3Upload),
+	}, nil
+}
+
+// withFS returns a copy of sh that serves pfs. The copy shares sh's
+// multipart uploads, so that uploads begun before contracts are reloaded can
+// still be completed.
+func (sh *s3Handler) withFS(pfs *renterutil.PseudoFS) *s3Handler {
+	sh2 := *sh
+	sh2.pfs = pfs
+	return &sh2
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3MaxSkew is the maximum difference between a request's timestamp and the
+// server's clock.
+const s3MaxSkew = 15 * time.Minute
+
+// awsEscape escapes s as required by AWS Signature Version 4: every byte
+// except unreserved characters (and, if keepSlash is true, '/') is
+// percent-encoded.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && keepSlash) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// s3Credential is the parsed Credential component of a SigV4 signature.
+type s3Credential struct {
+	accessKey string
+	date      string
+	region    string
+	service   string
+}
+
+func (c s3Credential) scope() string {
+	return c.date + "/" + c.region + "/" + c.service + "/aws4_request"
+}
+
+func parseS3Credential(s string) (s3Credential, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return s3Credential{}, errS3AuthMalformed
+	}
+	return s3Credential{parts[0], parts[1], parts[2], parts[3]}, nil
+}
+
+// canonicalRequest builds the canonical form of req, as defined by SigV4.
+// The X-Amz-Signature query parameter, if present, is excluded.
+func canonicalRequest(req *http.Request, signedHeaders []string, payloadHash string) string {
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		if k != "X-Amz-Signature" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		vals := append([]string(nil), query[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			params = append(params, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	var headers strings.Builder
+	for _, h := range signedHeaders {
+		var val string
+		if h == "host" {
+			val = req.Host
+		} else {
+			val = strings.Join(req.Header.Values(h), ",")
+		}
+		headers.WriteString(h + ":" + strings.Join(strings.Fields(val), " ") + "\n")
+	}
+	return strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, true),
+		strings.Join(params, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// An s3Signer computes SigV4 signatures for a particular request.
+type s3Signer struct {
+	key     []byte // derived from the secret key and credential scope
+	amzDate string
+	scope   string
+}
+
+func newS3Signer(secretKey string, cred s3Credential, amzDate string) *s3Signer {
+	key := hmacSHA256([]byte("AWS4"+secretKey), cred.date)
+	key = hmacSHA256(key, cred.region)
+	key = hmacSHA256(key, cred.service)
+	key = hmacSHA256(key, "aws4_request")
+	return &s3Signer{key: key, amzDate: amzDate, scope: cred.scope()}
+}
+
+// requestSignature returns the signature of a canonical request.
+func (s *s3Signer) requestSignature(canonical string) string {
+	stringToSign := "AWS4-HMAC-SHA256\n" + s.amzDate + "\n" + s.scope + "\n" + sha256Hex(canonical)
+	return hex.EncodeToString(hmacSHA256(s.key, stringToSign))
+}
+
+// chunkSignature returns the signature of a chunk of a streaming upload,
+// given the signature of the previous chunk (or, for the first chunk, of the
+// request itself).
+func (s *s3Signer) chunkSignature(prevSig string, data []byte) string {
+	h := sha256.Sum256(data)
+	stringToSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + s.amzDate + "\n" + s.scope + "\n" + prevSig + "\n" + sha256Hex("") + "\n" + hex.EncodeToString(h[:])
+	return hex.EncodeToString(hmacSHA256(s.key, stringToSign))
+}
+
+// s3StreamingPayload is the X-Amz-Content-Sha256 of a request whose body is
+// sent in signed chunks.
+const s3StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+
+// authenticate verifies the SigV4 signature of req, which may be supplied
+// either in the Authorization header or in the query string (a presigned
+// URL). If the body of req is sent in signed chunks, authenticate replaces
+// req.Body with a reader that decodes and verifies them.
+func (sh *s3Handler) authenticate(req *http.Request) error {
+	var cred s3Credential
+	var signedHeaders []string
+	var signature, amzDate, payloadHash string
+	var expires time.Duration
+	query := req.URL.Query()
+	if auth := req.Header.Get("Authorization"); auth != "" {
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+			return errS3AuthMalformed
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				return errS3AuthMalformed
+			}
+			switch kv[0] {
+			case "Credential":
+				var err error
+				if cred, err = parseS3Credential(kv[1]); err != nil {
+					return err
+				}
+			case "SignedHeaders":
+				signedHeaders = strings.Split(kv[1], ";")
+			case "Signature":
+				signature = kv[1]
+			}
+		}
+		amzDate = req.Header.Get("X-Amz-Date")
+		payloadHash = req.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			payloadHash = "UNSIGNED-PAYLOAD"
+		}
+		expires = s3MaxSkew
+	} else if query.Get("X-Amz-Algorithm") == "AWS4-HMAC-SHA256" {
+		var err error
+		if cred, err = parseS3Credential(query.Get("X-Amz-Credential")); err != nil {
+			return err
+		}
+		signedHeaders = strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = "UNSIGNED-PAYLOAD"
+		secs, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || secs < 0 {
+			return errS3AuthMalformed
+		}
+		expires = time.Duration(secs) * time.Second
+	} else {
+		return errS3AccessDenied
+	}
+	if signature == "" || len(signedHeaders) == 0 {
+		return errS3AuthMalformed
+	} else if !containsString(signedHeaders, "host") {
+		// otherwise, a signed request could be replayed against another server
+		return errS3AuthMalformed
+	} else if !constantTimeEqual(cred.accessKey, sh.accessKey) {
+		return errS3InvalidAccessKey
+	}
+	t, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return errS3AuthMalformed
+	} else if since := time.Since(t); since > expires || since < -s3MaxSkew {
+		if req.Header.Get("Authorization") == "" {
+			return errS3ExpiredURL
+		}
+		return errS3TimeSkewed
+	}
+	signer := newS3Signer(sh.secretKey, cred, amzDate)
+	canonical := canonicalRequest(req, signedHeaders, payloadHash)
+	if !hmac.Equal([]byte(signature), []byte(signer.requestSignature(canonical))) {
+		return errS3SignatureMismatch
+	}
+	if payloadHash == s3StreamingPayload {
+		req.Body = &awsChunkedReader{
+			r:       bufio.NewReader(req.Body),
+			body:    req.Body,
+			signer:  signer,
+			prevSig: signature,
+		}
+	}
+	return nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// maxS3ChunkSize is the maximum size of a chunk of an aws-chunked body. Signed
+// chunks are buffered until they have been verified.
+const maxS3ChunkSize = 16 << 20
+
+// An awsChunkedReader decodes a request body sent with the aws-chunked
+// content encoding. If signer is non-nil, each chunk's signature is verified
+// before any of its data is returned.
+type awsChunkedReader struct {
+	r       *bufio.Reader
+	body    io.Closer // may be nil
+	signer  *s3Signer // nil if chunks are unsigned
+	prevSig string
+
+	buf  []byte // unread data of the current chunk
+	done bool
+	err  error
+}
+
+// nextChunk reads and verifies the next chunk into cr.buf.
+func (cr *awsChunkedReader) nextChunk() error {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return errS3IncompleteBody
+	}
+	header := strings.TrimSpace(line)
+	sizeStr, ext := header, ""
+	if i := strings.IndexByte(header, ';'); i >= 0 {
+		sizeStr, ext = header[:i], header[i+1:]
+	}
+	size, err := strconv.ParseInt(sizeStr, 16, 64)
+	if err != nil || size < 0 || size > maxS3ChunkSize {
+		return errS3IncompleteBody
+	}
+	data := cr.buf[:0]
+	if int64(cap(data)) < size {
+		data = make([]byte, size)
+	}
+	data = data[:size]
+	if _, err := io.ReadFull(cr.r, data); err != nil {
+		return errS3IncompleteBody
+	}
+	if size > 0 {
+		// consume the trailing CRLF
+		if _, err := cr.r.Discard(2); err != nil {
+			return errS3IncompleteBody
+		}
+	}
+	if cr.signer != nil {
+		sig := strings.TrimPrefix(ext, "chunk-signature=")
+		if sig == ext || !hmac.Equal([]byte(sig), []byte(cr.signer.chunkSignature(cr.prevSig, data))) {
+			return errS3SignatureMismatch
+		}
+		cr.prevSig = sig
+	}
+	cr.done = size == 0
+	cr.buf = data
+	return nil
+}
+
+func (cr *awsChunkedReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		} else if cr.done {
+			return 0, io.EOF
+		}
+		cr.err = cr.nextChunk()
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+// Close implements io.Closer.
+func (cr *awsChunkedReader) Close() error {
+	if cr.body == nil {
+		return nil
+	}
+	return cr.body.Close()
+}
+
+// s3Body returns the decoded body of req. Bodies sent in signed chunks are
+// decoded by authenticate; unsigned aws-chunked bodies are decoded here.
+func s3Body(req *http.Request) io.Reader {
+	if _, ok := req.Body.(*awsChunkedReader); !ok && strings.Contains(req.Header.Get("Content-Encoding"), "aws-chunked") {
+		return &awsChunkedReader{r: bufio.NewReader(req.Body)}
+	}
+	return req.Body
+}
+
+// readS3Body reads and verifies the body of req, which is expected to be
+// small (e.g. XML).
+func readS3Body(req *http.Request) ([]byte, error) {
+	vr := newVerifiedReader(s3Body(req))
+	data, err := ioutil.ReadAll(io.LimitReader(vr, 1<<20))
+	if err != nil {
+		return nil, err
+	} else if err := vr.verify(req); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
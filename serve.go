@@ -2,40 +2,271 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
+	"github.com/pkg/errors"
 	"lukechampine.com/us/renter/renterutil"
 )
 
-func serve(hosts *renterutil.HostSet, metaDir, addr string) error {
-	pfs := renterutil.NewFileSystem(metaDir, hosts)
-	srv := &http.Server{
-		Addr:    addr,
-		Handler: http.FileServer(&httpFS{pfs}),
+// serveOptions are the settings for the serve command.
+type serveOptions struct {
+	addr         string
+	cache        *blockCache
+	cacheControl string
+	tlsCert      string
+	tlsKey       string
+	selfSigned   bool
+	user         string
+	password     string
+	token        string
+	shareSecret  string
+	webdav       bool
+	writable     bool
+	minShards    int
+	s3Addr       string
+	s3AccessKey  string
+	s3SecretKey  string
+
+	accessLog      string  // path, or "-" for stdout
+	rateLimit      float64 // requests per second per client
+	rateBurst      int
+	bandwidthLimit int64 // bytes per second
+
+	metrics string // address to serve metrics on; empty disables
+
+	reloader       *hostSetReloader // may be nil
+	reloadInterval time.Duration    // 0 disables periodic reloads
+}
+
+func serve(hosts *renterutil.HostSet, metaDir string, opts serveOptions) error {
+	var s3 *s3Handler
+	if opts.s3Addr != "" {
+		var err error
+		s3, err = newS3Handler(metaDir, opts.cache, opts.minShards, opts.s3AccessKey, opts.s3SecretKey)
+		if err != nil {
+			return errors.Wrap(err, "could not initialize S3 gateway")
+		}
+		defer os.RemoveAll(s3.partsDir)
+	}
+	// build the handlers for a HostSet; when contracts are reloaded, a new
+	// set of handlers is built and swapped in
+	build := func(hosts *renterutil.HostSet) *serveGeneration {
+		pfs := renterutil.NewFileSystem(metaDir, hosts)
+		hfs := &httpFS{pfs, metaDir, opts.cache}
+		files := &metaFileHandler{
+			h: &archiveHandler{
+				h: &etagHandler{
+					h:            fileServer{hfs},
+					root:         metaDir,
+					cacheControl: opts.cacheControl,
+				},
+				fs:   hfs,
+				root: metaDir,
+			},
+			root: metaDir,
+		}
+		// endpoints reachable via share links
+		shared := http.NewServeMux()
+		shared.Handle("/", files)
+		// authenticated endpoints
+		api := http.NewServeMux()
+		api.Handle("/", &uploadHandler{
+			h:         files,
+			pfs:       pfs,
+			root:      metaDir,
+			minShards: opts.minShards,
+			writable:  opts.writable,
+		})
+		api.Handle(metaPrefix, metaPathHandler{root: metaDir})
+		api.Handle(apiPrefix, &apiHandler{
+			pfs:  pfs,
+			root: metaDir,
+		})
+		if opts.webdav {
+			api.Handle(davPrefix, &davHandler{
+				pfs:       pfs,
+				root:      metaDir,
+				files:     files,
+				minShards: opts.minShards,
+			})
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/", &authHandler{
+			h:        api,
+			user:     opts.user,
+			password: opts.password,
+			token:    opts.token,
+		})
+		mux.Handle(sharePrefix, &shareHandler{
+			h:      shared,
+			secret: opts.shareSecret,
+		})
+		g := &serveGeneration{h: mux, closer: pfs}
+		if s3 != nil {
+			g.s3 = s3.withFS(pfs)
+		}
+		return g
+	}
+	gens := &generationSwapper{cur: build(hosts)}
+
+	auth := &authHandler{user: opts.user, password: opts.password, token: opts.token}
+	if !auth.enabled() && !isLoopback(opts.addr) {
+		log.Printf("WARNING: serving on %v without authentication; anyone who can reach this address can download your files", opts.addr)
+	}
+	var tlsConfig *tls.Config
+	if opts.selfSigned {
+		cert, fingerprint, err := selfSignedCert()
+		if err != nil {
+			return errors.Wrap(err, "could not generate certificate")
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		log.Printf("Generated self-signed certificate (SHA-256 fingerprint %v)", fingerprint)
+	}
+	// limits, metrics, and logging apply to every server
+	var bl *bandwidthLimiter
+	if opts.bandwidthLimit > 0 {
+		bl = newBandwidthLimiter(opts.bandwidthLimit)
+	}
+	var accessLog io.Writer
+	switch opts.accessLog {
+	case "":
+	case "-":
+		accessLog = os.Stdout
+	default:
+		f, err := os.OpenFile(opts.accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return errors.Wrap(err, "could not open access log")
+		}
+		defer f.Close()
+		accessLog = f
+	}
+	wrap := func(h http.Handler, endpoint string) http.Handler {
+		if bl != nil {
+			h = &bandwidthHandler{h: h, bl: bl}
+		}
+		if opts.rateLimit > 0 {
+			h = &rateLimitHandler{h: h, rate: opts.rateLimit, burst: opts.rateBurst}
+		}
+		if opts.metrics != "" {
+			h = &metricsHandler{h: h, endpoint: endpoint}
+		}
+		if accessLog != nil {
+			h = &accessLogHandler{h: h, w: accessLog}
+		}
+		return h
+	}
+	servers := []*http.Server{{
+		Addr:      opts.addr,
+		Handler:   wrap(generationHandler{gens, false}, ""),
+		TLSConfig: tlsConfig,
+	}}
+	if s3 != nil {
+		servers = append(servers, &http.Server{
+			Addr:      opts.s3Addr,
+			Handler:   wrap(generationHandler{gens, true}, "s3"),
+			TLSConfig: tlsConfig,
+		})
+	}
+
+	if opts.metrics != "" {
+		if err := serveMetrics(opts.metrics); err != nil {
+			return errors.Wrap(err, "could not serve metrics")
+		}
+		log.Printf("Serving metrics on http://%v/metrics", opts.metrics)
+	}
+
+	useTLS := opts.selfSigned || opts.tlsCert != ""
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	errChan := make(chan error, len(servers))
+	for _, srv := range servers {
+		log.Printf("Listening on %v://%v...", scheme, srv.Addr)
+		go func(srv *http.Server) {
+			if useTLS {
+				errChan <- srv.ListenAndServeTLS(opts.tlsCert, opts.tlsKey)
+			} else {
+				errChan <- srv.ListenAndServe()
+			}
+		}(srv)
+	}
+	// reload contracts periodically and on SIGHUP; in-flight requests finish
+	// using the old contracts. Reloads run one at a time, and requests for a
+	// reload that arrive while one is running are coalesced into one.
+	reloadChan := make(chan struct{}, 1)
+	requestReload := func() {
+		select {
+		case reloadChan <- struct{}{}:
+		default:
+		}
 	}
 	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt)
-		<-sigChan
-		log.Println("Stopping server...")
-		srv.Close()
-		pfs.Close()
+		for range reloadChan {
+			if opts.reloader == nil {
+				continue
+			}
+			hosts, err := opts.reloader.reload()
+			if err != nil {
+				log.Println("Could not reload contracts:", err)
+			} else if hosts != nil {
+				gens.swap(build(hosts))
+			}
+		}
 	}()
-	log.Printf("Listening on %v...", addr)
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		return err
+	defer close(reloadChan)
+	var tick <-chan time.Time
+	if opts.reloader != nil && opts.reloadInterval > 0 {
+		t := time.NewTicker(opts.reloadInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt)
+	var err error
+loop:
+	for {
+		select {
+		case <-hupChan:
+			log.Println("Reloading contracts...")
+			requestReload()
+		case <-tick:
+			requestReload()
+		case <-sigChan:
+			break loop
+		case err = <-errChan:
+			break loop
+		}
 	}
-	return nil
+	log.Println("Stopping server...")
+	for _, srv := range servers {
+		srv.Close()
+	}
+	if cerr := gens.close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // A bufferedFile wraps a renterutil.PseudoFile in a bufio.Reader for better
 // performance.
 type bufferedFile struct {
 	*renterutil.PseudoFile
+	fs *httpFS
 	br *bufio.Reader
+
+	dirents []os.FileInfo // remaining directory entries
+	listed  bool
 }
 
 func (f *bufferedFile) Read(p []byte) (int, error) {
@@ -45,6 +276,30 @@ func (f *bufferedFile) Read(p []byte) (int, error) {
 	return f.br.Read(p)
 }
 
+// Readdir implements http.File. Entries are listed by readDir, so metadata
+// entries are omitted.
+func (f *bufferedFile) Readdir(n int) ([]os.FileInfo, error) {
+	if !f.listed {
+		infos, err := readDir(f.fs.pfs, f.fs.root, f.Name())
+		if err != nil {
+			return nil, err
+		}
+		f.dirents, f.listed = infos, true
+	}
+	if n <= 0 {
+		infos := f.dirents
+		f.dirents = nil
+		return infos, nil
+	} else if len(f.dirents) == 0 {
+		return nil, io.EOF
+	} else if n > len(f.dirents) {
+		n = len(f.dirents)
+	}
+	infos := f.dirents[:n]
+	f.dirents = f.dirents[n:]
+	return infos, nil
+}
+
 func (f *bufferedFile) Seek(offset int64, whence int) (int64, error) {
 	n, err := f.PseudoFile.Seek(offset, whence)
 	if f.br != nil {
@@ -53,8 +308,43 @@ func (f *bufferedFile) Seek(offset int64, whence int) (int64, error) {
 	return n, err
 }
 
+// A cachedHTTPFile serves reads from a cachedFile.
+type cachedHTTPFile struct {
+	*renterutil.PseudoFile
+	cf  *cachedFile
+	off int64
+}
+
+func (f *cachedHTTPFile) Read(p []byte) (int, error) {
+	n, err := f.cf.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *cachedHTTPFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.cf.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seek position is before start of file")
+	}
+	f.off = offset
+	return offset, nil
+}
+
 type httpFS struct {
-	pfs *renterutil.PseudoFS
+	pfs   *renterutil.PseudoFS
+	root  string
+	cache *blockCache // may be nil
 }
 
 func (hfs *httpFS) Open(name string) (http.File, error) {
@@ -62,7 +352,16 @@ func (hfs *httpFS) Open(name string) (http.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &bufferedFile{
+	if hfs.cache != nil {
+		if stat, err := pf.Stat(); err == nil && !stat.IsDir() {
+			metaPath := filepath.Join(hfs.root, filepath.FromSlash(name)+metafileExt)
+			if cf, err := newCachedFile(pf, metaPath, hfs.cache); err == nil {
+				return newCountedFile(&cachedHTTPFile{PseudoFile: pf, cf: cf}), nil
+			}
+		}
+	}
+	return newCountedFile(&bufferedFile{
 		PseudoFile: pf,
-	}, nil
+		fs:         hfs,
+	}), nil
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sharePrefix is the URL prefix under which signed share links are served.
+const sharePrefix = "/share/"
+
+// shareSignature computes the signature of a share link for scope (a
+// slash-separated path relative to the metafolder) that expires at the given
+// Unix time. Links to metafiles are signed separately, so that a link to a
+// file's contents cannot be used to obtain its metafile, or vice versa.
+func shareSignature(secret, scope string, expires int64, meta bool) string {
+	msg := strconv.FormatInt(expires, 10) + "\n" + scope
+	if meta {
+		msg = metaFileQuery + "\n" + msg
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// splitPath splits a cleaned slash-separated path into its components.
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// shareURL returns a signed URL granting access to p, a file or directory
+// within the metafolder served at baseURL, until ttl has elapsed. If meta is
+// true, the URL grants access to the metafile of p instead.
+func shareURL(baseURL, secret, p string, ttl time.Duration, meta bool) (string, error) {
+	if secret == "" {
+		return "", errors.New("share_secret is not set in your config file")
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid server URL")
+	}
+	scope := splitPath(path.Clean("/" + p))
+	expires := time.Now().Add(ttl).Unix()
+	sig := shareSignature(secret, strings.Join(scope, "/"), expires, meta)
+	token := strconv.FormatInt(expires, 10) + "." + strconv.Itoa(len(scope)) + "." + sig
+	u := &url.URL{
+		Scheme: base.Scheme,
+		Host:   base.Host,
+		Path:   strings.TrimSuffix(base.Path, "/") + sharePrefix + token + "/" + strings.Join(scope, "/"),
+	}
+	if meta {
+		u.RawQuery = metaFileQuery
+	}
+	return u.String(), nil
+}
+
+// A shareHandler serves requests for share links, bypassing authentication.
+// A link takes the form /share/<expires>.<n>.<sig>/<scope>/..., where scope is
+// the first n components of the remaining path. Any path within scope may be
+// requested, so that shared directories can be browsed. Links to metafiles
+// carry the metafile query parameter, which is covered by the signature.
+type shareHandler struct {
+	h      http.Handler
+	secret string
+}
+
+// ServeHTTP implements http.Handler.
+func (sh *shareHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p, ok, err := sh.verify(req.URL.Path, isMetaFileQuery(req))
+	if !ok {
+		if err == nil {
+			http.NotFound(w, req)
+		} else {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		}
+		return
+	}
+	// serve p as if it had been requested directly
+	r2 := new(http.Request)
+	*r2 = *req
+	r2.URL = new(url.URL)
+	*r2.URL = *req.URL
+	r2.URL.Path = p
+	r2.URL.RawPath = ""
+	sh.h.ServeHTTP(w, r2)
+}
+
+// verify checks the signature of the share link reqPath, returning the path
+// within the metafolder that it refers to. If reqPath is not a valid share
+// link, verify returns false, along with an error if the link is invalid
+// (rather than merely nonexistent).
+func (sh *shareHandler) verify(reqPath string, meta bool) (string, bool, error) {
+	if sh.secret == "" || !strings.HasPrefix(reqPath, sharePrefix) {
+		return "", false, nil
+	}
+	rest := strings.TrimPrefix(reqPath, sharePrefix)
+	i := strings.IndexByte(rest, '/')
+	if i < 0 {
+		return "", false, nil
+	}
+	token, p := rest[:i], path.Clean(rest[i:])
+	if strings.HasSuffix(rest, "/") && p != "/" {
+		p += "/" // preserve trailing slash, which FileServer uses for directories
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false, nil
+	}
+	expires, err1 := strconv.ParseInt(parts[0], 10, 64)
+	n, err2 := strconv.Atoi(parts[1])
+	segs := splitPath(p)
+	if err1 != nil || err2 != nil || n < 0 || n > len(segs) {
+		return "", false, nil
+	}
+	sig := shareSignature(sh.secret, strings.Join(segs[:n], "/"), expires, meta)
+	if !hmac.Equal([]byte(sig), []byte(parts[2])) {
+		return "", false, errors.New("invalid share link")
+	} else if time.Now().Unix() > expires {
+		return "", false, errors.New("share link has expired")
+	}
+	return p, true, nil
+}
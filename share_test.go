@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestShareHandler(t *testing.T) {
+	const secret = "foo"
+	var served string
+	sh := &shareHandler{
+		h: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			served = req.URL.String()
+		}),
+		secret: secret,
+	}
+	get := func(rawURL string) int {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		served = ""
+		rec := httptest.NewRecorder()
+		sh.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, u.RequestURI(), nil))
+		return rec.Code
+	}
+
+	data, err := shareURL("http://localhost:8080", secret, "photos", time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := shareURL("http://localhost:8080", secret, "photos/a.jpg", time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url    string
+		code   int
+		served string
+	}{
+		{data + "/a.jpg", http.StatusOK, "/photos/a.jpg"},
+		{data + "/a.jpg?archive=zip", http.StatusOK, "/photos/a.jpg?archive=zip"},
+		{data + "/a.jpg?metafile", http.StatusForbidden, ""}, // data links don't grant metafiles
+		{meta, http.StatusOK, "/photos/a.jpg?metafile"},
+		{meta[:len(meta)-len("?metafile")], http.StatusForbidden, ""}, // nor vice versa
+	}
+	for _, test := range tests {
+		if code := get(test.url); code != test.code {
+			t.Errorf("%v: expected %v, got %v", test.url, test.code, code)
+		} else if served != test.served {
+			t.Errorf("%v: expected to serve %q, got %q", test.url, test.served, served)
+		}
+	}
+
+	expired, err := shareURL("http://localhost:8080", secret, "photos", -time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if code := get(expired); code != http.StatusForbidden {
+		t.Errorf("expired link: expected %v, got %v", http.StatusForbidden, code)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/renter/renterutil"
+)
+
+// davPrefix is the URL prefix of the WebDAV endpoint.
+const davPrefix = "/dav/"
+
+// A davHandler implements a WebDAV server backed by a PseudoFS. It supports
+// enough of RFC 4918 for common clients (davfs2, rclone, Finder, Windows
+// Explorer) to browse, read, and write files. Locks are accepted but not
+// enforced.
+type davHandler struct {
+	pfs       *renterutil.PseudoFS
+	root      string
+	files     http.Handler // serves GET and HEAD requests
+	minShards int
+}
+
+// name returns the PseudoFS name corresponding to the URL path p.
+func (dh *davHandler) name(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.TrimPrefix(p, davPrefix)), "/")
+}
+
+// href returns the URL path of name.
+func (dh *davHandler) href(name string, isDir bool) string {
+	p := (&url.URL{Path: davPrefix + name}).EscapedPath()
+	if isDir && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return p
+}
+
+// davError writes an HTTP error corresponding to err.
+func davError(w http.ResponseWriter, req *http.Request, err error) {
+	noteError(req, err)
+	cause := errors.Cause(err)
+	switch {
+	case os.IsNotExist(cause):
+		http.Error(w, "not found", http.StatusNotFound)
+	case os.IsExist(cause):
+		http.Error(w, "already exists", http.StatusMethodNotAllowed)
+	case os.IsPermission(cause):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	default:
+		log.Printf("%v %v: %v", req.Method, req.URL.Path, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (dh *davHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodOptions:
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("MS-Author-Via", "DAV")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, MKCOL, MOVE, LOCK, UNLOCK")
+	case http.MethodGet, http.MethodHead:
+		http.StripPrefix(strings.TrimSuffix(davPrefix, "/"), dh.files).ServeHTTP(w, req)
+	case "PROPFIND":
+		dh.propfind(w, req)
+	case http.MethodPut:
+		dh.put(w, req)
+	case "MKCOL":
+		dh.mkcol(w, req)
+	case http.MethodDelete:
+		dh.delete(w, req)
+	case "MOVE":
+		dh.move(w, req)
+	case "LOCK":
+		dh.lock(w, req)
+	case "UNLOCK":
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XMLNS     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection,omitempty"`
+}
+
+func (dh *davHandler) response(name string, info os.FileInfo) davResponse {
+	prop := davProp{
+		DisplayName:  info.Name(),
+		LastModified: info.ModTime().UTC().Format(http.TimeFormat),
+	}
+	if info.IsDir() {
+		prop.ResourceType.Collection = new(struct{})
+	} else {
+		size := info.Size()
+		prop.ContentLength = &size
+		prop.ContentType = mime.TypeByExtension(path.Ext(name))
+	}
+	return davResponse{
+		Href: dh.href(name, info.IsDir()),
+		Propstat: davPropstat{
+			Prop:   prop,
+			Status: "HTTP/1.1 200 OK",
+		},
+	}
+}
+
+// propfind lists the properties of a file or directory. The request body is
+// ignored; all supported properties are always returned. A Depth of
+// "infinity" is treated as 1.
+func (dh *davHandler) propfind(w http.ResponseWriter, req *http.Request) {
+	io.Copy(ioutil.Discard, req.Body)
+	name := dh.name(req.URL.Path)
+	info, err := dh.pfs.Stat(name)
+	if err != nil {
+		davError(w, req, err)
+		return
+	}
+	ms := davMultistatus{
+		XMLNS:     "DAV:",
+		Responses: []davResponse{dh.response(name, info)},
+	}
+	if info.IsDir() && req.Header.Get("Depth") != "0" {
+		infos, err := readDir(dh.pfs, dh.root, name)
+		if err != nil {
+			davError(w, req, err)
+			return
+		}
+		for _, info := range infos {
+			ms.Responses = append(ms.Responses, dh.response(path.Join(name, info.Name()), info))
+		}
+	}
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(ms)
+}
+
+// put uploads the request body to a new file, replacing any existing file.
+func (dh *davHandler) put(w http.ResponseWriter, req *http.Request) {
+	name := dh.name(req.URL.Path)
+	info, err := dh.pfs.Stat(name)
+	if err == nil && info.IsDir() {
+		http.Error(w, "cannot overwrite a directory", http.StatusMethodNotAllowed)
+		return
+	}
+	existed := err == nil
+	if _, err := dh.pfs.Stat(path.Dir(name)); err != nil {
+		http.Error(w, "parent directory does not exist", http.StatusConflict)
+		return
+	}
+	minShards, err := dirMinShards(dh.root, path.Dir(name), dh.minShards, 0)
+	if err != nil {
+		davError(w, req, err)
+		return
+	}
+	if err := uploadPseudoFile(dh.pfs, name, req.Body, minShards); err != nil {
+		davError(w, req, err)
+		return
+	}
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// uploadPseudoFile uploads the contents of r to name, replacing any existing
+// file only once the upload has succeeded.
+func uploadPseudoFile(pfs *renterutil.PseudoFS, name string, r io.Reader, minShards int) error {
+	tmp, err := stagePseudoFile(pfs, name, r, minShards)
+	if err != nil {
+		return err
+	}
+	return commitPseudoFile(pfs, tmp, name)
+}
+
+// stagePseudoFile uploads the contents of r to a new temporary file alongside
+// name, returning the temporary file's name. If the upload fails, the
+// temporary file is removed.
+func stagePseudoFile(pfs *renterutil.PseudoFS, name string, r io.Reader, minShards int) (string, error) {
+	tmp := tempName(name)
+	pf, err := pfs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666, minShards)
+	if err != nil {
+		return "", err
+	}
+	atomic.AddInt64(&openFiles, 1)
+	defer atomic.AddInt64(&openFiles, -1)
+	if _, err := io.Copy(pf, r); err != nil {
+		pf.Close()
+		pfs.Remove(tmp)
+		return "", err
+	}
+	// ensure the data has been uploaded, rather than merely buffered
+	if err := pf.Sync(); err != nil {
+		pf.Close()
+		pfs.Remove(tmp)
+		return "", err
+	}
+	if err := pf.Close(); err != nil {
+		pfs.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// commitPseudoFile renames tmp, a file created by stagePseudoFile, to name.
+// If name already exists, tmp takes on its mode.
+func commitPseudoFile(pfs *renterutil.PseudoFS, tmp, name string) error {
+	if info, err := pfs.Stat(name); err == nil && !info.IsDir() {
+		pfs.Chmod(tmp, info.Mode())
+	}
+	if err := pfs.Rename(tmp, name); err != nil {
+		pfs.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (dh *davHandler) mkcol(w http.ResponseWriter, req *http.Request) {
+	if req.ContentLength > 0 {
+		http.Error(w, "request body not supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	name := dh.name(req.URL.Path)
+	if _, err := dh.pfs.Stat(name); err == nil {
+		http.Error(w, "already exists", http.StatusMethodNotAllowed)
+		return
+	} else if _, err := dh.pfs.Stat(path.Dir(name)); err != nil {
+		http.Error(w, "parent directory does not exist", http.StatusConflict)
+		return
+	}
+	if err := dh.pfs.Mkdir(name, 0755); err != nil {
+		davError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (dh *davHandler) delete(w http.ResponseWriter, req *http.Request) {
+	name := dh.name(req.URL.Path)
+	if name == "" {
+		http.Error(w, "cannot delete root", http.StatusForbidden)
+		return
+	}
+	info, err := dh.pfs.Stat(name)
+	if err != nil {
+		davError(w, req, err)
+		return
+	}
+	if info.IsDir() {
+		err = dh.pfs.RemoveAll(name)
+	} else {
+		err = dh.pfs.Remove(name)
+	}
+	if err != nil {
+		davError(w, req, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (dh *davHandler) move(w http.ResponseWriter, req *http.Request) {
+	dest, err := url.Parse(req.Header.Get("Destination"))
+	if err != nil || !strings.HasPrefix(dest.Path, davPrefix) {
+		http.Error(w, "invalid destination", http.StatusBadRequest)
+		return
+	}
+	oldName, newName := dh.name(req.URL.Path), dh.name(dest.Path)
+	if oldName == "" || newName == "" {
+		http.Error(w, "cannot move root", http.StatusForbidden)
+		return
+	} else if oldName == newName {
+		http.Error(w, "source and destination are the same", http.StatusForbidden)
+		return
+	}
+	if _, err := dh.pfs.Stat(oldName); err != nil {
+		davError(w, req, err)
+		return
+	} else if _, err := dh.pfs.Stat(path.Dir(newName)); err != nil {
+		http.Error(w, "parent directory does not exist", http.StatusConflict)
+		return
+	}
+	info, err := dh.pfs.Stat(newName)
+	existed := err == nil
+	if !existed {
+		info = nil
+	} else if req.Header.Get("Overwrite") == "F" {
+		http.Error(w, "destination exists", http.StatusPreconditionFailed)
+		return
+	}
+	if err := dh.rename(oldName, newName, info); err != nil {
+		davError(w, req, err)
+		return
+	}
+	if existed {
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// rename renames oldName to newName. If newName exists (as described by
+// info), it is moved aside first, and is only removed once the rename
+// succeeds; otherwise, it is restored.
+func (dh *davHandler) rename(oldName, newName string, info os.FileInfo) error {
+	if info == nil {
+		return dh.pfs.Rename(oldName, newName)
+	}
+	backup := tempName(newName)
+	if err := dh.pfs.Rename(newName, backup); err != nil {
+		return err
+	}
+	if err := dh.pfs.Rename(oldName, newName); err != nil {
+		if rerr := dh.pfs.Rename(backup, newName); rerr != nil {
+			log.Printf("Could not restore %v from %v: %v", newName, backup, rerr)
+		}
+		return err
+	}
+	var err error
+	if info.IsDir() {
+		err = dh.pfs.RemoveAll(backup)
+	} else {
+		err = dh.pfs.Remove(backup)
+	}
+	if err != nil {
+		log.Printf("Could not remove %v: %v", backup, err)
+	}
+	return nil
+}
+
+// lock grants an exclusive write lock that is never enforced. Some clients
+// (notably Finder and Windows Explorer) refuse to write without one.
+func (dh *davHandler) lock(w http.ResponseWriter, req *http.Request) {
+	io.Copy(ioutil.Discard, req.Body)
+	token := "opaquelocktoken:" + strconv.FormatInt(time.Now().UnixNano(), 16)
+	w.Header().Set("Lock-Token", "<"+token+">")
+	w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	io.WriteString(w, xml.Header+`<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>`+
+		`<D:locktype><D:write/></D:locktype><D:lockscope><D:exclusive/></D:lockscope>`+
+		`<D:depth>infinity</D:depth><D:timeout>Second-3600</D:timeout>`+
+		`<D:locktoken><D:href>`+token+`</D:href></D:locktoken>`+
+		`</D:activelock></D:lockdiscovery></D:prop>`)
+}